@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// blocklist file format
+const (
+	FormatHosts   = "hosts"
+	FormatDomains = "domains"
+	FormatAdblock = "adblock"
+)
+
+// BlocklistOption blocklist subscription file option
+type BlocklistOption struct {
+	Path   string `json:"path" label:"blocklist file path"`
+	Format string `json:"format" label:"blocklist file format: hosts, domains, adblock"`
+	Action string `json:"action" label:"blocked query answer action: nxdomain, refused, empty, null"`
+}
+
+// Init check blocklist option and fill default value
+func (b *BlocklistOption) Init() error {
+	if "" == b.Path {
+		return errors.New("proxy: blocklist path is empty")
+	}
+
+	b.Format = strings.ToLower(b.Format)
+	switch b.Format {
+	case "":
+		b.Format = FormatHosts
+	case FormatHosts, FormatDomains, FormatAdblock:
+	default:
+		return errors.New("proxy: blocklist " + b.Path + " not support format " + b.Format)
+	}
+
+	b.Action = strings.ToLower(b.Action)
+	switch b.Action {
+	case "":
+		b.Action = ActionNXDomain
+	case ActionNXDomain, ActionRefused, ActionEmpty, ActionNull:
+	default:
+		return errors.New("proxy: blocklist " + b.Path + " not support action " + b.Action)
+	}
+
+	return nil
+}
+
+// DomainSet compiled domain matcher, lookup cost is the label count of the query host
+type DomainSet struct {
+	exact  map[string]struct{} `label:"match the domain only"`
+	suffix map[string]struct{} `label:"match the domain and all subdomain"`
+}
+
+// NewDomainSet create empty domain set
+func NewDomainSet() *DomainSet {
+	return &DomainSet{
+		exact:  make(map[string]struct{}),
+		suffix: make(map[string]struct{}),
+	}
+}
+
+// AddExact add domain match itself only
+func (d *DomainSet) AddExact(domain string) {
+	d.exact[domain] = struct{}{}
+}
+
+// AddSuffix add domain match itself and all subdomain
+func (d *DomainSet) AddSuffix(domain string) {
+	d.suffix[domain] = struct{}{}
+}
+
+// Length number of domain in the set
+func (d *DomainSet) Length() int {
+	return len(d.exact) + len(d.suffix)
+}
+
+// Match check host is in the set, host must be lower case without the trailing dot
+func (d *DomainSet) Match(host string) bool {
+	if _, ok := d.exact[host]; ok {
+		return true
+	}
+
+	for {
+		if _, ok := d.suffix[host]; ok {
+			return true
+		}
+
+		var idx = strings.IndexByte(host, '.')
+		if -1 == idx {
+			break
+		}
+		host = host[idx+1:]
+	}
+
+	return false
+}
+
+// Blocklist compiled blocklist subscription
+type Blocklist struct {
+	action string     `label:"blocked query answer action"`
+	block  *DomainSet `label:"blocked domain set"`
+	allow  *DomainSet `label:"adblock exception domain set"`
+}
+
+// NewBlocklist load blocklist file and compile the domain matcher
+func NewBlocklist(option *BlocklistOption) (*Blocklist, error) {
+	var fp, err = os.Open(option.Path)
+	if nil != err {
+		return nil, err
+	}
+	defer fp.Close()
+
+	var b = &Blocklist{
+		action: option.Action,
+		block:  NewDomainSet(),
+		allow:  NewDomainSet(),
+	}
+
+	var scanner = bufio.NewScanner(fp)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		switch option.Format {
+		case FormatHosts:
+			b.parseHosts(scanner.Text())
+		case FormatDomains:
+			b.parseDomain(scanner.Text())
+		case FormatAdblock:
+			b.parseAdblock(scanner.Text())
+		}
+	}
+	if err = scanner.Err(); nil != err {
+		return nil, errors.New("proxy: read blocklist " + option.Path + " failed, " + err.Error())
+	}
+
+	return b, nil
+}
+
+// Length number of blocked domain
+func (b *Blocklist) Length() int {
+	return b.block.Length()
+}
+
+// Match check host is blocked, host must be lower case without the trailing dot
+func (b *Blocklist) Match(host string) bool {
+	return b.block.Match(host) && !b.allow.Match(host)
+}
+
+// parseHosts parse /etc/hosts format line: ip host [host...]
+func (b *Blocklist) parseHosts(line string) {
+	if idx := strings.IndexByte(line, '#'); -1 != idx {
+		line = line[:idx]
+	}
+
+	var fields = strings.Fields(line)
+	for i := 1; i < len(fields); i++ {
+		var host = strings.Trim(strings.ToLower(fields[i]), ".")
+		switch host {
+		case "localhost", "localhost.localdomain", "local", "broadcasthost", "ip6-localhost", "ip6-loopback":
+			continue
+		}
+
+		if isBlockDomain(host) {
+			b.block.AddExact(host)
+		}
+	}
+}
+
+// parseDomain parse one domain per line format, the domain and all subdomain is blocked
+func (b *Blocklist) parseDomain(line string) {
+	if idx := strings.IndexByte(line, '#'); -1 != idx {
+		line = line[:idx]
+	}
+
+	var host = strings.Trim(strings.ToLower(strings.TrimSpace(line)), ".")
+	if isBlockDomain(host) {
+		b.block.AddSuffix(host)
+	}
+}
+
+// parseAdblock parse adblock style domain rule: ||example.com^ and @@||example.com^
+// other rule like cosmetic filter or url path is not for dns and ignored
+func (b *Blocklist) parseAdblock(line string) {
+	var set = b.block
+
+	line = strings.TrimSpace(line)
+	if "" == line || '!' == line[0] || '#' == line[0] || '[' == line[0] {
+		return
+	}
+
+	if strings.HasPrefix(line, "@@") {
+		set = b.allow
+		line = line[2:]
+	}
+	if !strings.HasPrefix(line, "||") {
+		return
+	}
+	line = line[2:]
+
+	if idx := strings.IndexByte(line, '$'); -1 != idx {
+		if "important" != line[idx+1:] {
+			return
+		}
+		line = line[:idx]
+	}
+	line = strings.TrimSuffix(line, "^")
+
+	var host = strings.Trim(strings.ToLower(line), ".")
+	if isBlockDomain(host) {
+		set.AddSuffix(host)
+	}
+}
+
+// isBlockDomain check the value is a valid domain for blocklist
+func isBlockDomain(host string) bool {
+	if "" == host || strings.ContainsAny(host, "/*:^|") {
+		return false
+	}
+
+	var _, ok = dns.IsDomainName(host)
+
+	return ok
+}
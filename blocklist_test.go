@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestBlocklistFormat(t *testing.T) {
+	var dir = t.TempDir()
+	var files = map[string]string{
+		FormatHosts:   "# hosts blocklist\n127.0.0.1 localhost\n0.0.0.0 ads.example.com tracker.example.com # inline\n::1 ip6-localhost\n",
+		FormatDomains: "# domain list\nDoubleClick.net\n\nmetrics.example.org.\nbad/domain\n",
+		FormatAdblock: "! adblock list\n[Adblock Plus 2.0]\n||adservice.com^\n||popup.net^$important\n||script.net^$third-party\n@@||good.adservice.com^\nexample.com##.banner\n/banner/*\n",
+	}
+	var cases = []struct {
+		format  string
+		count   int
+		host    string
+		blocked bool
+	}{
+		{FormatHosts, 2, "ads.example.com", true},
+		{FormatHosts, 2, "www.ads.example.com", false},
+		{FormatHosts, 2, "localhost", false},
+		{FormatDomains, 2, "doubleclick.net", true},
+		{FormatDomains, 2, "stats.g.doubleclick.net", true},
+		{FormatDomains, 2, "example.org", false},
+		{FormatAdblock, 2, "x.adservice.com", true},
+		{FormatAdblock, 2, "good.adservice.com", false},
+		{FormatAdblock, 2, "popup.net", true},
+		{FormatAdblock, 2, "script.net", false},
+	}
+
+	for _, c := range cases {
+		var option = &BlocklistOption{Path: filepath.Join(dir, c.format), Format: c.format}
+		if err := option.Init(); nil != err {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(option.Path, []byte(files[c.format]), 0644); nil != err {
+			t.Fatal(err)
+		}
+
+		var list, err = NewBlocklist(option)
+		if nil != err {
+			t.Fatal(err)
+		}
+		if list.Length() != c.count {
+			t.Errorf("blocklist %s got %d domains, want %d", c.format, list.Length(), c.count)
+		}
+		if list.Match(c.host) != c.blocked {
+			t.Errorf("blocklist %s match %s got %v, want %v", c.format, c.host, !c.blocked, c.blocked)
+		}
+	}
+
+	// the blocklist loaded to the filter answer by the action of the list
+	var filter = NewFilter(nil)
+	var option = &BlocklistOption{Path: filepath.Join(dir, FormatDomains), Format: FormatDomains}
+	if err := option.Init(); nil != err {
+		t.Fatal(err)
+	}
+	if cnt, err := filter.Load(option); nil != err || 2 != cnt {
+		t.Fatalf("filter load blocklist got %d %v", cnt, err)
+	}
+	if action := filter.Match("stats.doubleclick.net.", dns.TypeA); option.Action != action || filter.Empty() {
+		t.Errorf("filter blocklist match got %q", action)
+	}
+}
+
+func BenchmarkDomainSetMatch(b *testing.B) {
+	var set = NewDomainSet()
+	for i := 0; i < 300000; i++ {
+		set.AddSuffix("host-" + strconv.Itoa(i) + ".example.com")
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		set.Match("a.b.c.d.not-blocked.example.org")
+	}
+}
@@ -1,103 +1,160 @@
 package main
 
 import (
-	"sync"
+	"container/list"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
+// cache eviction policy
+const (
+	PolicyLRU = "lru"
+	PolicyLFU = "lfu"
+)
+
+// sweepLimit number of item every shard check in one incremental expire sweep
+const sweepLimit = 64
+
 // CacheItem DNS cache message item
 type CacheItem struct {
-	Hit    int64    `label:"query cache hit count"`
-	Expire int64    `label:"dns query result cache exprice, zero is never expire"`
-	Msg    *dns.Msg `label:"dns query result"`
+	Hit      int64         `label:"query cache hit count"`
+	Create   int64         `label:"dns query result cache create time"`
+	Expire   int64         `label:"dns query result cache exprice, zero is never expire"`
+	Msg      *dns.Msg      `label:"dns query result"`
+	Prefetch bool          `label:"item is refreshed by prefetch and not hit yet"`
+	key      string        `label:"dns query cache key"`
+	size     int64         `label:"approximate memory bytes of the item"`
+	elem     *list.Element `label:"position in the recently used list"`
+}
+
+// CacheStats dns query cache statistics
+type CacheStats struct {
+	Count      int    `json:"count" label:"number of cache item"`
+	Size       int64  `json:"size" label:"approximate memory bytes of cache item"`
+	Hits       uint64 `json:"hits" label:"cache hit count"`
+	Misses     uint64 `json:"misses" label:"cache miss count"`
+	Evicts     uint64 `json:"evicts" label:"item evicted by size or count limit"`
+	Expires    uint64 `json:"expires" label:"expired item removed by gc"`
+	Prefetched uint64 `json:"prefetched" label:"prefetched item hit by client"`
+	MaxSize    int64  `json:"max_size" label:"cache memory budget"`
+	MaxCount   int    `json:"max_count" label:"cache item count limit"`
+	Policy     string `json:"policy" label:"cache eviction policy"`
+	Shards     int    `json:"shards" label:"number of cache store shard"`
 }
 
 // Cache memory base dns query cache
-// TODO 计划要添加一个后台线程，对查询次数多的进行后台更新来加速整体性能
 type Cache struct {
-	MaxCount int                   `label:"number of dns query cache item, zero is not limit"`
-	MinTTL   int64                 `label:"min cache time, zero is not limit"`
-	MaxTTL   int64                 `label:"max cache time, zero is not limit"`
-	mu       *sync.RWMutex         `label:"query cache read & write lock"`
-	backend  map[string]*CacheItem `label:"dns query cache store"`
+	MaxCount  int        `label:"number of dns query cache item, zero is not limit"`
+	MaxSize   int64      `label:"approximate memory bytes of dns query cache, zero is not limit"`
+	MinTTL    int64      `label:"min cache time, zero is not limit"`
+	MaxTTL    int64      `label:"max cache time, zero is not limit"`
+	NegMinTTL int64      `label:"min cache time of negative answer, also used when negative answer has no soa record"`
+	NegMaxTTL int64      `label:"max cache time of negative answer, zero is not limit"`
+	StaleTTL  int64      `label:"max time an expired item can be served as stale answer, negative is disable serve stale"`
+	Policy    string     `label:"cache eviction policy: lru, lfu"`
+	hits      uint64     `label:"cache hit count"`
+	misses    uint64     `label:"cache miss count"`
+	store     CacheStore `label:"dns query cache store"`
+}
+
+// NewCache create dns query cache, one shard use the single lock store
+func NewCache(maxSize int64, maxCount int, policy string, shards int) *Cache {
+	var store CacheStore
+
+	if "" == policy {
+		policy = PolicyLRU
+	}
+	if shards > 1 {
+		store = NewShardStore(maxSize, maxCount, policy, shards)
+	} else {
+		store = NewLRUStore(maxSize, maxCount, policy)
+	}
+
+	return &Cache{
+		MaxCount: maxCount,
+		MaxSize:  maxSize,
+		Policy:   policy,
+		store:    store,
+	}
 }
 
 // Get get query cache
 func (c *Cache) Get(key string) (*dns.Msg, error) {
 	var err error
 	var msg *dns.Msg
+	var now = time.Now().Unix()
 
-	c.mu.RLock()
-	if item, ok := c.backend[key]; ok {
+	if item, ok := c.store.Get(key); !ok {
+		err = ErrNotFound
+	} else if item.Expire > 0 && item.Expire < now && (c.StaleTTL < 0 || now-item.Expire > c.StaleTTL) {
+		err = ErrNotFound
+	} else {
 		msg = item.Msg.Copy()
-		if item.Expire > 0 && item.Expire < time.Now().Unix() {
-			err = ErrCacheExpire
+		if item.Expire > 0 {
+			if item.Expire < now {
+				err = ErrCacheExpire
+			}
+
+			agingTTL(msg, now-item.Create, item.Expire-now)
 		}
+	}
+
+	if ErrNotFound == err {
+		atomic.AddUint64(&c.misses, 1)
 	} else {
-		err = ErrNotFound
+		atomic.AddUint64(&c.hits, 1)
 	}
-	c.mu.RUnlock()
 
 	return msg, err
 }
 
+// Peek get cache item hit count and expire time without update the recently used list
+func (c *Cache) Peek(key string) (CacheItem, bool) {
+	var item, ok = c.store.Peek(key)
+
+	return CacheItem{Hit: item.Hit, Create: item.Create, Expire: item.Expire}, ok
+}
+
 // Set Set query cache
 func (c *Cache) Set(key string, msg *CacheItem) bool {
-	c.mu.Lock()
-	c.backend[key] = msg
-	c.mu.Unlock()
+	c.store.Set(key, msg)
 
 	return true
 }
 
 // Remove remove query cache
 func (c *Cache) Remove(key string) {
-	c.mu.Lock()
-	delete(c.backend, key)
-	c.mu.Unlock()
+	c.store.Remove(key)
 }
 
 // IsExpire check dns cache is expire
 func (c *Cache) IsExpire(key string) bool {
-	var flag bool
-
-	c.mu.RLock()
-	if item, ok := c.backend[key]; ok {
-		if item.Expire > 0 && item.Expire < time.Now().Unix() {
-			flag = true
-		}
-	}
-	c.mu.RUnlock()
+	var item, ok = c.store.Peek(key)
 
-	return flag
+	return ok && item.Expire > 0 && item.Expire < time.Now().Unix()
 }
 
+// GC incremental remove the item expired and out of the stale window
 func (c *Cache) GC() {
-	var expire = time.Now().Unix() - 86400
-
-	c.mu.Lock()
-	for k, v := range c.backend {
-		if v.Expire > 0 && v.Expire < expire {
-			delete(c.backend, k)
-		}
+	var expire = time.Now().Unix()
+	if c.StaleTTL > 0 {
+		expire -= c.StaleTTL
 	}
-	c.mu.Unlock()
+
+	c.store.Sweep(expire, sweepLimit)
 }
 
 // Reset reset dns query cache result
 func (c *Cache) Reset() {
-	c.mu.Lock()
-	c.backend = make(map[string]*CacheItem, 10240)
-	c.mu.Unlock()
+	c.store.Reset()
 }
 
 // Exists cache is exists
 func (c *Cache) Exists(key string) bool {
-	c.mu.RLock()
-	_, ok := c.backend[key]
-	c.mu.RUnlock()
+	var _, ok = c.store.Peek(key)
 
 	return ok
 }
@@ -108,9 +165,109 @@ func (c *Cache) Full() bool {
 	return c.MaxCount > 0 && c.Length() >= c.MaxCount
 }
 
+// TTL get cache time of dns message, it is the min record ttl limit by MinTTL and MaxTTL
+// negative answer (RFC 2308) use the soa ttl limit by NegMinTTL and NegMaxTTL
+func (c *Cache) TTL(msg *dns.Msg) int64 {
+	return c.LimitTTL(msg, c.MinTTL, c.MaxTTL)
+}
+
+// LimitTTL get cache time of dns message, the min record ttl is limit by the min and max ttl of the forwarder group
+// negative answer still use the soa ttl limit by NegMinTTL and NegMaxTTL
+func (c *Cache) LimitTTL(msg *dns.Msg, minTTL int64, maxTTL int64) int64 {
+	if isNegative(msg) {
+		minTTL, maxTTL = c.NegMinTTL, c.NegMaxTTL
+	}
+
+	var ttl, ok = recordTTL(msg)
+	if !ok || (minTTL > 0 && ttl < minTTL) {
+		ttl = minTTL
+	}
+	if maxTTL > 0 && ttl > maxTTL {
+		ttl = maxTTL
+	}
+
+	return ttl
+}
+
+// Cacheable check dns message can be cached
+// only NOERROR and NXDOMAIN answer is cached, SERVFAIL and other error must not be cached
+// truncated answer is incomplete and is not cached either
+func (c *Cache) Cacheable(msg *dns.Msg) bool {
+	if nil == msg || 0 == len(msg.Question) || msg.Truncated {
+		return false
+	}
+
+	return dns.RcodeSuccess == msg.Rcode || dns.RcodeNameError == msg.Rcode
+}
+
 // Length cache length
 func (c *Cache) Length() int {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	return len(c.backend)
+	return c.store.Length()
+}
+
+// Stats get cache statistics
+func (c *Cache) Stats() *CacheStats {
+	var stats = c.store.Stats()
+
+	stats.Hits = atomic.LoadUint64(&c.hits)
+	stats.Misses = atomic.LoadUint64(&c.misses)
+
+	return stats
+}
+
+// cacheKey get cache key of dns query question
+func cacheKey(q dns.Question) string {
+	return q.String() + "|" + strconv.FormatUint(uint64(q.Qtype), 10)
+}
+
+// isNegative check dns message is NXDOMAIN or NODATA answer
+func isNegative(msg *dns.Msg) bool {
+	return dns.RcodeNameError == msg.Rcode || (dns.RcodeSuccess == msg.Rcode && 0 == len(msg.Answer))
+}
+
+// recordTTL get min record ttl in the answer and authority section
+// negative answer use the soa minimum field as ttl limit, false is message has no record
+func recordTTL(msg *dns.Msg) (int64, bool) {
+	var ok bool
+	var ttl int64
+
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns} {
+		for _, rr := range section {
+			var val = int64(rr.Header().Ttl)
+			if soa, flag := rr.(*dns.SOA); flag && isNegative(msg) && int64(soa.Minttl) < val {
+				val = int64(soa.Minttl)
+			}
+
+			if !ok || val < ttl {
+				ok = true
+				ttl = val
+			}
+		}
+	}
+
+	return ttl, ok
+}
+
+// agingTTL decrease record ttl by the time it has spent in the cache
+// the ttl will not less than the remaining cache time, so a record extend by MinTTL will not count down to zero
+func agingTTL(msg *dns.Msg, elapsed int64, remaining int64) {
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			var hdr = rr.Header()
+			if dns.TypeOPT == hdr.Rrtype {
+				continue
+			}
+
+			var ttl = int64(hdr.Ttl) - elapsed
+			if ttl < remaining {
+				ttl = remaining
+			}
+
+			hdr.Ttl = uint32(ttl)
+		}
+	}
 }
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func newTestMsg(name string, rr ...string) *dns.Msg {
+	var msg = new(dns.Msg)
+	msg.SetQuestion(name, dns.TypeA)
+	msg.Response = true
+
+	for _, v := range rr {
+		var record, err = dns.NewRR(v)
+		if nil != err {
+			panic(err)
+		}
+
+		if dns.TypeSOA == record.Header().Rrtype {
+			msg.Ns = append(msg.Ns, record)
+		} else {
+			msg.Answer = append(msg.Answer, record)
+		}
+	}
+
+	return msg
+}
+
+func TestCacheTTL(t *testing.T) {
+	var cache = &Cache{MinTTL: 60, MaxTTL: 3600, NegMinTTL: 30, NegMaxTTL: 300}
+	var nxdomain = newTestMsg("f.example.com.", "example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 7200 900 1209600 120")
+	nxdomain.Rcode = dns.RcodeNameError
+
+	var cases = []struct {
+		msg *dns.Msg
+		ttl int64
+	}{
+		{newTestMsg("a.example.com.", "a.example.com. 300 IN A 192.0.2.1", "a.example.com. 120 IN A 192.0.2.2"), 120},
+		{newTestMsg("b.example.com.", "b.example.com. 5 IN A 192.0.2.1"), 60},
+		{newTestMsg("c.example.com.", "c.example.com. 86400 IN A 192.0.2.1"), 3600},
+		{newTestMsg("d.example.com.", "example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 7200 900 1209600 600"), 300},
+		{newTestMsg("e.example.com."), 30},
+		{nxdomain, 120},
+	}
+
+	for _, c := range cases {
+		if ttl := cache.TTL(c.msg); ttl != c.ttl {
+			t.Errorf("cache ttl of %s got %d, want %d", c.msg.Question[0].Name, ttl, c.ttl)
+		}
+	}
+
+	// the positive answer is limit by the ttl of the forwarder group, the negative answer is not
+	if ttl := cache.LimitTTL(cases[1].msg, 600, 7200); 600 != ttl {
+		t.Errorf("group min ttl got %d", ttl)
+	}
+	if ttl := cache.LimitTTL(cases[2].msg, 600, 7200); 7200 != ttl {
+		t.Errorf("group max ttl got %d", ttl)
+	}
+	if ttl := cache.LimitTTL(cases[3].msg, 600, 7200); 300 != ttl {
+		t.Errorf("negative ttl should not be limit by group, got %d", ttl)
+	}
+}
+
+func TestCacheAgingTTL(t *testing.T) {
+	var now = time.Now().Unix()
+	var cache = NewCache(0, 0, PolicyLRU, 1)
+
+	cache.Set("a", &CacheItem{
+		Msg:    newTestMsg("a.example.com.", "a.example.com. 300 IN A 192.0.2.1"),
+		Create: now - 100,
+		Expire: now + 200,
+	})
+	cache.Set("b", &CacheItem{
+		Msg:    newTestMsg("b.example.com.", "b.example.com. 5 IN A 192.0.2.1"),
+		Create: now - 10,
+		Expire: now + 50,
+	})
+
+	var msg, err = cache.Get("a")
+	if nil != err || 200 != msg.Answer[0].Header().Ttl {
+		t.Errorf("cache aging ttl got %v %v, want 200", msg, err)
+	}
+
+	msg, err = cache.Get("b")
+	if nil != err || 50 != msg.Answer[0].Header().Ttl {
+		t.Errorf("cache aging ttl extend by min ttl got %v %v, want 50", msg, err)
+	}
+}
+
+func TestCacheEvict(t *testing.T) {
+	var now = time.Now().Unix()
+	var newItem = func(name string) *CacheItem {
+		return &CacheItem{
+			Msg:    newTestMsg(name, name+" 300 IN A 192.0.2.1"),
+			Create: now,
+			Expire: now + 300,
+		}
+	}
+
+	var lru = NewCache(0, 3, PolicyLRU, 1)
+	lru.Set("a", newItem("a.example.com."))
+	lru.Set("b", newItem("b.example.com."))
+	lru.Set("c", newItem("c.example.com."))
+	lru.Get("a")
+	lru.Set("d", newItem("d.example.com."))
+	if lru.Exists("b") || !lru.Exists("a") || 3 != lru.Length() || 1 != lru.Stats().Evicts {
+		t.Errorf("lru cache evict unexpected item, stats %+v", lru.Stats())
+	}
+
+	var lfu = NewCache(0, 3, PolicyLFU, 1)
+	lfu.Set("a", newItem("a.example.com."))
+	lfu.Get("a")
+	lfu.Get("a")
+	lfu.Set("b", newItem("b.example.com."))
+	lfu.Get("b")
+	lfu.Set("c", newItem("c.example.com."))
+	lfu.Set("d", newItem("d.example.com."))
+	if lfu.Exists("c") || !lfu.Exists("a") || !lfu.Exists("b") {
+		t.Errorf("lfu cache evict unexpected item, stats %+v", lfu.Stats())
+	}
+
+	var item = newItem("e.example.com.")
+	var sized = NewCache(3*(int64(item.Msg.Len())+cacheItemOverhead+1), 0, PolicyLRU, 1)
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		sized.Set(k, newItem(k+".example.com."))
+	}
+	var stats = sized.Stats()
+	if stats.Size > stats.MaxSize || 0 == stats.Evicts || sized.Exists("a") {
+		t.Errorf("size limit cache is not bounded, stats %+v", stats)
+	}
+}
+
+func TestCacheCacheable(t *testing.T) {
+	var cache = NewCache(0, 0, PolicyLRU, 1)
+	var cases = map[int]bool{
+		dns.RcodeSuccess:        true,
+		dns.RcodeNameError:      true,
+		dns.RcodeServerFailure:  false,
+		dns.RcodeRefused:        false,
+		dns.RcodeNotImplemented: false,
+	}
+
+	for rcode, flag := range cases {
+		var msg = newTestMsg("a.example.com.")
+		msg.Rcode = rcode
+
+		if cache.Cacheable(msg) != flag {
+			t.Errorf("cacheable of rcode %s got %v, want %v", dns.RcodeToString[rcode], !flag, flag)
+		}
+	}
+
+	var msg = newTestMsg("a.example.com.")
+	msg.Truncated = true
+	if cache.Cacheable(msg) {
+		t.Error("truncated answer should not be cached")
+	}
+}
+
+func TestCacheStaleWindow(t *testing.T) {
+	var now = time.Now().Unix()
+	var cache = NewCache(0, 0, PolicyLRU, 1)
+	cache.StaleTTL = 60
+
+	cache.Set("a", &CacheItem{
+		Msg:    newTestMsg("a.example.com.", "a.example.com. 300 IN A 192.0.2.1"),
+		Create: now - 330,
+		Expire: now - 30,
+	})
+	cache.Set("b", &CacheItem{
+		Msg:    newTestMsg("b.example.com.", "b.example.com. 300 IN A 192.0.2.1"),
+		Create: now - 400,
+		Expire: now - 100,
+	})
+
+	if msg, err := cache.Get("a"); ErrCacheExpire != err || 0 != msg.Answer[0].Header().Ttl {
+		t.Errorf("cache item in stale window got %v %v, want expired", msg, err)
+	}
+	if _, err := cache.Get("b"); ErrNotFound != err {
+		t.Errorf("cache item out of stale window got %v, want not found", err)
+	}
+
+	cache.StaleTTL = -1
+	if _, err := cache.Get("a"); ErrNotFound != err {
+		t.Errorf("cache item with serve stale disabled got %v, want not found", err)
+	}
+}
@@ -6,33 +6,119 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"math/rand"
 	"strings"
-	"time"
 )
 
 var configFile = flag.String("c", "../conf/proxy.json", "dns proxy server config file")
 
-// DNSFilter dns query filter
-type DNSFilter struct {
-	Host          string `label:"dns query host"`
-	QueryType     uint16 `label:"dns query type"`
-	ExactMatching bool   `label:""`
+// TLSOption tls certificate option of encrypted dns listener
+type TLSOption struct {
+	Cert        string `json:"cert" label:"certificate chain file path in pem format"`
+	Key         string `json:"key" label:"private key file path in pem format"`
+	IdleTimeout int64  `json:"idle_timeout" label:"idle timeout in second of dns over tls connection, default is 10"`
+}
+
+// ForwarderGroup forwarder server group option, the plain server address array is also accepted
+type ForwarderGroup struct {
+	Servers        []string `json:"servers" label:"forwarder server address list"`
+	Timeout        int64    `json:"timeout" label:"query timeout of the group in millisecond, default is 600"`
+	AttemptTimeout int64    `json:"attempt_timeout" label:"timeout of one forwarder in millisecond before the next forwarder is queried, default is timeout that only failover on error"`
+	Concurrency    int      `json:"concurrency" label:"number of forwarder queried at the same time, default is the global concurrency"`
+	Retries        int      `json:"retries" label:"retry times when every forwarder failed or timeout, default is 0"`
+	Strategy       string   `json:"strategy" label:"forwarder selection strategy, default is random"`
+	Protocol       string   `json:"protocol" label:"transport of the server address without scheme: udp, tcp, tls, https, quic, default is udp"`
+	MinTTL         int64    `json:"min_ttl" label:"min cache time of the answer of the group in second, default is the global min_ttl"`
+	MaxTTL         int64    `json:"max_ttl" label:"max cache time of the answer of the group in second, default is the global max_ttl"`
+}
+
+// UnmarshalJSON decode forwarder group from server address array or group object
+func (g *ForwarderGroup) UnmarshalJSON(data []byte) error {
+	if trim := strings.TrimSpace(string(data)); strings.HasPrefix(trim, "[") {
+		return json.Unmarshal(data, &g.Servers)
+	}
+
+	type group ForwarderGroup
+
+	return json.Unmarshal(data, (*group)(g))
+}
+
+// Init check forwarder group option and set the default value
+func (g *ForwarderGroup) Init(concurrency int) error {
+	if 0 == len(g.Servers) {
+		return errors.New("proxy: forwarder group servers is empty")
+	}
+	if g.Timeout <= 0 {
+		g.Timeout = 600
+	}
+	if g.AttemptTimeout <= 0 || g.AttemptTimeout > g.Timeout {
+		g.AttemptTimeout = g.Timeout
+	}
+	if g.Concurrency <= 0 {
+		g.Concurrency = concurrency
+	}
+	if g.Retries < 0 {
+		g.Retries = 0
+	}
+	if _, err := NewStrategy(g.Strategy, nil, nil); nil != err {
+		return err
+	}
+
+	g.Protocol = strings.ToLower(g.Protocol)
+	switch g.Protocol {
+	case "", "udp", "tcp", "tls", "https", "quic":
+	default:
+		return errors.New("proxy: not support forwarder protocol " + g.Protocol)
+	}
+
+	return nil
+}
+
+// Address get the forwarder address with the group protocol scheme
+func (g *ForwarderGroup) Address(server string) string {
+	if "" == g.Protocol || strings.Contains(server, "://") {
+		return server
+	}
+
+	return g.Protocol + "://" + server
 }
 
 // Config dns proxy config option
 type Config struct {
-	Cache       int                 `json:"cache" label:"dns query cache size"`
-	Concurrency int                 `json:"concurrency" label:"spec max concurrency backend forwarder server"`
-	Rand        *rand.Rand          `json:"-" label:"forwarder server index"`
-	Name        string              `json:"name" label:"dns server name"`
-	Pid         string              `json:"pid" label:"pid file path"`
-	Logger      *LoggerOption       `json:"logger" label:"logger option"`
-	Bind        map[string]string   `json:"bind" label:"dns proxy bind"`
-	Rules       map[string]string   `json:"rules" label:"dns query forwarder rule"`
-	Forwarders  map[string][]string `json:"forwarders" label:"dns query forwarder server list"`
-	Mapper      []string            `json:"mapper" label:"domain to ip mapper"`
-	Filters     []DNSFilter         `json:"filters" label:"dns proxy filter rule"`
+	Cache               int                        `json:"cache" label:"dns query cache size"`
+	CacheCount          int                        `json:"cache_count" label:"max number of dns query cache item, zero is not limit"`
+	CachePolicy         string                     `json:"cache_policy" label:"cache eviction policy: lru, lfu"`
+	CacheShards         int                        `json:"cache_shards" label:"number of cache lock shard, default is 32"`
+	CacheFile           string                     `json:"cache_file" label:"query cache snapshot file, empty is not persist the cache"`
+	CacheSave           int64                      `json:"cache_save_interval" label:"save query cache snapshot interval in second, default is 300, negative is only save on shutdown"`
+	Concurrency         int                        `json:"concurrency" label:"default number of forwarder queried at the same time"`
+	MinTTL              int64                      `json:"min_ttl" label:"min cache time in second, default is 60"`
+	MaxTTL              int64                      `json:"max_ttl" label:"max cache time in second, default is 86400"`
+	NegMinTTL           int64                      `json:"negative_min_ttl" label:"min cache time of NXDOMAIN and NODATA answer in second, default is 30"`
+	NegMaxTTL           int64                      `json:"negative_max_ttl" label:"max cache time of NXDOMAIN and NODATA answer in second, default is 3600"`
+	StaleTTL            int64                      `json:"stale_ttl" label:"max time in second an expired answer can be served stale, default is 86400, negative is disable"`
+	StaleAnswer         int64                      `json:"stale_answer_ttl" label:"record ttl of stale answer in second, default is 30"`
+	StaleWait           int64                      `json:"stale_timeout" label:"client response deadline in millisecond before serve stale answer, default is 500"`
+	PrefetchHits        int64                      `json:"prefetch_hits" label:"min hit count of cache item to trigger prefetch, default is 3, negative is disable"`
+	PrefetchPercent     int64                      `json:"prefetch_percent" label:"trigger prefetch when the percent of cache ttl has elapsed, default is 90"`
+	PrefetchConcurrency int                        `json:"prefetch_concurrency" label:"max concurrency prefetch upstream query, default is 8"`
+	HealthFails         int                        `json:"health_fails" label:"consecutive failure to eject forwarder, default is 3, negative is never eject"`
+	HealthBackoff       int64                      `json:"health_backoff" label:"first probe interval in second of ejected forwarder, default is 10"`
+	HealthMaxBackoff    int64                      `json:"health_max_backoff" label:"max probe interval in second of ejected forwarder, default is 300"`
+	HealthCanary        string                     `json:"health_canary" label:"probe query name of ejected forwarder, default is the root"`
+	Name                string                     `json:"name" label:"dns server name"`
+	Pid                 string                     `json:"pid" label:"pid file path"`
+	Logger              *LoggerOption              `json:"logger" label:"logger option"`
+	Bind                map[string]string          `json:"bind" label:"dns proxy bind"`
+	TLS                 *TLSOption                 `json:"tls" label:"tls certificate of https, tls and quic listener"`
+	Rules               map[string]string          `json:"rules" label:"dns query forwarder rule"`
+	RuleFiles           []RuleFileOption           `json:"rule_files" label:"dns query forwarder rule file"`
+	Forwarders          map[string]*ForwarderGroup `json:"forwarders" label:"dns query forwarder server group"`
+	Weights             map[string]int             `json:"weights" label:"forwarder weight of weighted strategy, default is 1"`
+	Mapper              []string                   `json:"mapper" label:"domain to ip mapper"`
+	Zones               []ZoneOption               `json:"zones" label:"authoritative local zone file"`
+	TSIG                map[string]string          `json:"tsig" label:"tsig key name to base64 secret"`
+	Filters             []DNSFilter                `json:"filters" label:"dns proxy filter rule"`
+	Blocklists          []BlocklistOption          `json:"blocklists" label:"blocklist subscription file"`
 }
 
 // NewConfig create config object instance
@@ -62,13 +148,76 @@ func NewConfig(test bool) (*Config, error) {
 		}
 	}
 
-	config.Rand = rand.New(rand.NewSource(time.Now().Unix()))
 	if 0 == config.Cache {
 		config.Cache = 256 * 1024 * 1024
 	}
+	config.CachePolicy = strings.ToLower(config.CachePolicy)
+	if "" == config.CachePolicy {
+		config.CachePolicy = PolicyLRU
+	}
+	if PolicyLRU != config.CachePolicy && PolicyLFU != config.CachePolicy {
+		return nil, errors.New("proxy: not support cache policy " + config.CachePolicy)
+	}
+	if config.CacheShards <= 0 {
+		config.CacheShards = 32
+	}
+	if 0 == config.CacheSave {
+		config.CacheSave = 300
+	}
 	if 0 == config.Concurrency {
 		config.Concurrency = 3
 	}
+	if config.MinTTL <= 0 {
+		config.MinTTL = 60
+	}
+	if config.MaxTTL <= 0 {
+		config.MaxTTL = 86400
+	}
+	if config.MaxTTL < config.MinTTL {
+		return nil, errors.New("proxy: max_ttl must not less than min_ttl")
+	}
+	if config.NegMinTTL <= 0 {
+		config.NegMinTTL = 30
+	}
+	if config.NegMaxTTL <= 0 {
+		config.NegMaxTTL = 3600
+	}
+	if config.NegMaxTTL < config.NegMinTTL {
+		return nil, errors.New("proxy: negative_max_ttl must not less than negative_min_ttl")
+	}
+	if 0 == config.StaleTTL {
+		config.StaleTTL = 86400
+	}
+	if config.StaleAnswer <= 0 {
+		config.StaleAnswer = 30
+	}
+	if config.StaleWait <= 0 {
+		config.StaleWait = 500
+	}
+	if 0 == config.PrefetchHits {
+		config.PrefetchHits = 3
+	}
+	if config.PrefetchPercent <= 0 || config.PrefetchPercent >= 100 {
+		config.PrefetchPercent = 90
+	}
+	if config.PrefetchConcurrency <= 0 {
+		config.PrefetchConcurrency = 8
+	}
+	if 0 == config.HealthFails {
+		config.HealthFails = 3
+	}
+	if config.HealthBackoff <= 0 {
+		config.HealthBackoff = 10
+	}
+	if config.HealthMaxBackoff <= 0 {
+		config.HealthMaxBackoff = 300
+	}
+	if config.HealthMaxBackoff < config.HealthBackoff {
+		config.HealthMaxBackoff = config.HealthBackoff
+	}
+	if "" == config.HealthCanary {
+		config.HealthCanary = "."
+	}
 
 	if "" == config.Name {
 		config.Name = "dns.proxy.server."
@@ -79,13 +228,13 @@ func NewConfig(test bool) (*Config, error) {
 
 	// check forwarder rule
 	if nil == config.Forwarders {
-		config.Forwarders = make(map[string][]string)
+		config.Forwarders = make(map[string]*ForwarderGroup)
 	}
 	if _, ok := config.Forwarders["normal"]; !ok {
-		config.Forwarders["normal"] = []string{"119.29.29.29:53"}
+		config.Forwarders["normal"] = &ForwarderGroup{Servers: []string{"119.29.29.29:53"}}
 	}
 	if _, ok := config.Forwarders["gfw"]; !ok {
-		config.Forwarders["gfw"] = []string{"1.1.1.1:53", "80.80.80.80:53", "80.80.81.81:53", "8.8.8.8:53", "8.8.4.4:53"}
+		config.Forwarders["gfw"] = &ForwarderGroup{Servers: []string{"1.1.1.1:53", "80.80.80.80:53", "80.80.81.81:53", "8.8.8.8:53", "8.8.4.4:53"}}
 	}
 	if nil == config.Rules || 0 == len(config.Rules) {
 		config.Rules = map[string]string{
@@ -95,13 +244,91 @@ func NewConfig(test bool) (*Config, error) {
 	if _, ok := config.Rules["default"]; !ok {
 		return nil, errors.New("proxy: miss default forwarder group rule")
 	}
+	for k, v := range config.Forwarders {
+		if nil == v {
+			return nil, errors.New("proxy: forwarder group " + k + " is empty")
+		}
+		if err = v.Init(config.Concurrency); nil != err {
+			return nil, errors.New(err.Error() + ", group " + k)
+		}
+		if v.MinTTL <= 0 {
+			v.MinTTL = config.MinTTL
+		}
+		if v.MaxTTL <= 0 {
+			v.MaxTTL = config.MaxTTL
+		}
+		if v.MaxTTL < v.MinTTL {
+			return nil, errors.New("proxy: max_ttl must not less than min_ttl, group " + k)
+		}
+	}
+	var rules = NewRuleTrie()
 	for k, v := range config.Rules {
 		if _, ok := config.Forwarders[v]; !ok {
-			if 2 != len(strings.Split(k, ".")) {
-				return nil, errors.New("proxy: forwarder rule domain format is xxx.xx, give " + k)
+			return nil, errors.New("proxy: domain " + k + " map forwarder " + v + " is not exist")
+		}
+		if "default" != k {
+			if err = rules.Add(k, v); nil != err {
+				return nil, err
 			}
+		}
+	}
+	for i := range config.RuleFiles {
+		if err = config.RuleFiles[i].Init(); nil != err {
+			return nil, err
+		}
+		if _, ok := config.Forwarders[config.RuleFiles[i].Group]; !ok {
+			return nil, errors.New("proxy: rule file " + config.RuleFiles[i].Path + " map forwarder " + config.RuleFiles[i].Group + " is not exist")
+		}
+	}
 
-			return nil, errors.New("proxy: domain" + k + "map forwarder" + v + "is not exist")
+	// check query filter rule
+	for i := range config.Filters {
+		if err = config.Filters[i].Init(); nil != err {
+			return nil, err
+		}
+	}
+
+	// check authoritative local zone
+	var keys TSIGKeys
+	if keys, err = NewTSIGKeys(config.TSIG); nil != err {
+		return nil, err
+	}
+	var zones = make(map[string]bool, len(config.Zones))
+	for i := range config.Zones {
+		if err = config.Zones[i].Init(); nil != err {
+			return nil, err
+		}
+		if zones[config.Zones[i].Name] {
+			return nil, errors.New("proxy: zone " + config.Zones[i].Name + " is duplicated")
+		}
+		zones[config.Zones[i].Name] = true
+		if _, ok := keys[config.Zones[i].TransferKey]; "" != config.Zones[i].TransferKey && !ok {
+			return nil, errors.New("proxy: zone " + config.Zones[i].Name + " transfer key " + config.Zones[i].TransferKey + " is not exist")
+		}
+		if _, ok := keys[config.Zones[i].UpdateKey]; "" != config.Zones[i].UpdateKey && !ok {
+			return nil, errors.New("proxy: zone " + config.Zones[i].Name + " update key " + config.Zones[i].UpdateKey + " is not exist")
+		}
+	}
+
+	// check blocklist subscription
+	for i := range config.Blocklists {
+		if err = config.Blocklists[i].Init(); nil != err {
+			return nil, err
+		}
+	}
+
+	// check tls certificate option
+	if nil != config.TLS {
+		if "" == config.TLS.Cert || "" == config.TLS.Key {
+			return nil, errors.New("proxy: tls option miss cert or key file")
+		}
+		if config.TLS.IdleTimeout <= 0 {
+			config.TLS.IdleTimeout = 10
+		}
+	}
+	for _, network := range []string{"https", "tls", "quic"} {
+		if addr, ok := config.Bind[network]; ok && nil == config.TLS {
+			return nil, errors.New("proxy: " + network + " bind " + addr + " miss tls option")
 		}
 	}
 
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestForwarderGroup(t *testing.T) {
+	var forwarders map[string]*ForwarderGroup
+	var data = `{
+		"normal": ["223.5.5.5:53", "tls://1.1.1.1"],
+		"office": {"servers": ["10.0.0.53"], "timeout": 2000, "retries": 1, "strategy": "sequential-failover", "protocol": "TCP"}
+	}`
+	if err := json.Unmarshal([]byte(data), &forwarders); nil != err {
+		t.Fatal(err)
+	}
+
+	for _, group := range forwarders {
+		if err := group.Init(3); nil != err {
+			t.Fatal(err)
+		}
+	}
+
+	var normal = forwarders["normal"]
+	if 2 != len(normal.Servers) || 600 != normal.Timeout || 600 != normal.AttemptTimeout || 3 != normal.Concurrency || "223.5.5.5:53" != normal.Address(normal.Servers[0]) {
+		t.Errorf("plain server array group got %+v", normal)
+	}
+	var office = forwarders["office"]
+	if 2000 != office.Timeout || 2000 != office.AttemptTimeout || 1 != office.Retries || "tcp://10.0.0.53" != office.Address(office.Servers[0]) || "tls://1.1.1.1" != office.Address("tls://1.1.1.1") {
+		t.Errorf("group object got %+v", office)
+	}
+
+	for _, group := range []*ForwarderGroup{{}, {Servers: []string{"a"}, Strategy: "nearest"}, {Servers: []string{"a"}, Protocol: "sctp"}} {
+		if err := group.Init(3); nil == err {
+			t.Errorf("invalid forwarder group %+v should failed", group)
+		}
+	}
+}
+
+func TestConfigTLSBind(t *testing.T) {
+	var path = filepath.Join(t.TempDir(), "proxy.json")
+	var file = *configFile
+	*configFile = path
+	defer func() { *configFile = file }()
+
+	var cases = map[string]bool{
+		`{"bind": {"udp": ":53", "tls": ":853"}}`: false,
+		`{"bind": {"https": ":443"}}`:             false,
+		`{"bind": {"quic": ":853"}}`:              false,
+		`{"bind": {"quic": ":853"}, "tls": {"cert": "server.crt", "key": "server.key"}}`: true,
+		`{"bind": {"udp": ":53", "http": ":8080"}}`:                                      true,
+	}
+	for data, ok := range cases {
+		if err := os.WriteFile(path, []byte(data), 0644); nil != err {
+			t.Fatal(err)
+		}
+		if _, err := NewConfig(true); ok != (nil == err) {
+			t.Errorf("config %s got error %v", data, err)
+		}
+	}
+}
+
+func TestConfigGroupTTL(t *testing.T) {
+	var path = filepath.Join(t.TempDir(), "proxy.json")
+	var file = *configFile
+	*configFile = path
+	defer func() { *configFile = file }()
+
+	var data = `{"min_ttl": 120, "rules": {"default": "normal", "cdn.example.com": "cdn"},
+		"forwarders": {"normal": ["223.5.5.5:53"], "cdn": {"servers": ["119.29.29.29:53"], "min_ttl": 10, "max_ttl": 300}}}`
+	if err := os.WriteFile(path, []byte(data), 0644); nil != err {
+		t.Fatal(err)
+	}
+
+	var config, err = NewConfig(true)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if normal := config.Forwarders["normal"]; 120 != normal.MinTTL || 86400 != normal.MaxTTL {
+		t.Errorf("group ttl should default to global ttl, got %d %d", normal.MinTTL, normal.MaxTTL)
+	}
+	if cdn := config.Forwarders["cdn"]; 10 != cdn.MinTTL || 300 != cdn.MaxTTL {
+		t.Errorf("group ttl got %d %d", cdn.MinTTL, cdn.MaxTTL)
+	}
+
+	data = `{"rules": {"default": "normal"}, "forwarders": {"normal": {"servers": ["223.5.5.5:53"], "min_ttl": 600, "max_ttl": 60}}}`
+	if err = os.WriteFile(path, []byte(data), 0644); nil != err {
+		t.Fatal(err)
+	}
+	if _, err = NewConfig(true); nil == err {
+		t.Error("group max_ttl less than min_ttl should failed")
+	}
+}
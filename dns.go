@@ -1,9 +1,14 @@
 package main
 
 import (
+	"time"
+
 	"github.com/miekg/dns"
 )
 
+// transferSize max size of one zone transfer message, the zone is sent in multiple message
+const transferSize = 16 * 1024
+
 // NameServer dns name server
 type NameServer struct {
 	server  *dns.Server
@@ -37,10 +42,25 @@ func NewNameServer(service *Service, net string, addr string) (ReverseProxy, boo
 	ns.server.Addr = addr
 	ns.server.Net = net
 	ns.server.Handler = mux
+	ns.server.TsigProvider = ns
+	ns.server.MsgAcceptFunc = acceptUpdate
 
 	return ns, true
 }
 
+// acceptUpdate accept the dynamic update besides the query, the update section can contain many record
+func acceptUpdate(dh dns.Header) dns.MsgAcceptAction {
+	if opcode := int(dh.Bits>>11) & 0xF; dns.OpcodeUpdate == opcode && 0 == dh.Bits&(1<<15) {
+		if 1 != dh.Qdcount {
+			return dns.MsgReject
+		}
+
+		return dns.MsgAccept
+	}
+
+	return dns.DefaultMsgAcceptFunc(dh)
+}
+
 // Start server
 func (ns *NameServer) Start() error {
 	return ns.server.ListenAndServe()
@@ -52,19 +72,118 @@ func (ns *NameServer) Stop() error {
 }
 
 // handle query process handle
+// the connection is not closed after answer, so tcp client can send multiple query on one connection
 func (ns *NameServer) handle(w dns.ResponseWriter, req *dns.Msg) {
-	defer w.Close()
-
 	if req.MsgHdr.Response {
 		return
 	}
+	if dns.OpcodeUpdate == req.Opcode {
+		ns.update(w, req)
+
+		return
+	}
+	if 1 == len(req.Question) && (dns.TypeAXFR == req.Question[0].Qtype || dns.TypeIXFR == req.Question[0].Qtype) {
+		ns.transfer(w, req)
+
+		return
+	}
 
 	var resp, err = ns.service.Query(w.RemoteAddr().String(), req)
 	if nil != err {
 		ns.service.Logger.Write(LevelError, " [E] client %s query %#v error: %v\n", w.RemoteAddr().String(), req, err)
 	} else if nil == resp {
 		ns.service.Logger.Write(LevelError, " [E] client %s query %#v result is empty\n", w.RemoteAddr().String(), req)
-	} else if err = w.WriteMsg(resp); nil != err {
+	} else if err = w.WriteMsg(ns.truncate(req, resp)); nil != err {
 		ns.service.Logger.Write(LevelError, " [E] send result to client %s %#v error: %v\n", w.RemoteAddr().String(), req, err)
 	}
 }
+
+// transfer answer AXFR and IXFR of the local zone, the record is split to multiple message signed by the request TSIG key
+// the transfer over udp only get the SOA, so the client retry over tcp (RFC 1995)
+func (ns *NameServer) transfer(w dns.ResponseWriter, req *dns.Msg) {
+	var src = w.RemoteAddr().String()
+	var rrs, rcode = ns.service.Transfer(src, req, w.TsigStatus())
+	if dns.RcodeSuccess == rcode && "udp" == ns.server.Net {
+		if dns.TypeAXFR == req.Question[0].Qtype {
+			rrs, rcode = nil, dns.RcodeRefused
+		} else {
+			rrs = rrs[:1]
+		}
+	}
+	if dns.RcodeSuccess != rcode {
+		if err := w.WriteMsg(new(dns.Msg).SetRcode(req, rcode)); nil != err {
+			ns.service.Logger.Write(LevelError, " [E] send transfer result to client %s error: %v\n", src, err)
+		}
+
+		return
+	}
+
+	var ch = make(chan *dns.Envelope)
+	go func() {
+		defer close(ch)
+
+		var size int
+		var batch []dns.RR
+		for _, rr := range rrs {
+			if size+dns.Len(rr) > transferSize && 0 != len(batch) {
+				ch <- &dns.Envelope{RR: batch}
+				size, batch = 0, nil
+			}
+			size += dns.Len(rr)
+			batch = append(batch, rr)
+		}
+		ch <- &dns.Envelope{RR: batch}
+	}()
+
+	if err := new(dns.Transfer).Out(w, req, ch); nil != err {
+		ns.service.Logger.Write(LevelError, " [E] send transfer result to client %s error: %v\n", src, err)
+	}
+
+	// drain the rest message, so the sender is not blocked when the client is gone
+	for range ch {
+	}
+}
+
+// update apply the dynamic update of the local zone, the answer is signed by the request TSIG key when it is verified
+func (ns *NameServer) update(w dns.ResponseWriter, req *dns.Msg) {
+	var src = w.RemoteAddr().String()
+	var resp = new(dns.Msg).SetRcode(req, ns.service.Update(src, req, w.TsigStatus()))
+	if tsig := req.IsTsig(); nil != tsig && nil == w.TsigStatus() {
+		resp.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsig.Fudge, time.Now().Unix())
+	}
+
+	if err := w.WriteMsg(resp); nil != err {
+		ns.service.Logger.Write(LevelError, " [E] send update result to client %s error: %v\n", src, err)
+	}
+}
+
+// Generate sign the answer by the tsig key of the service, the key is reloaded with the config
+func (ns *NameServer) Generate(msg []byte, t *dns.TSIG) ([]byte, error) {
+	return ns.service.tsig.Generate(msg, t)
+}
+
+// Verify verify the request by the tsig key of the service
+func (ns *NameServer) Verify(msg []byte, t *dns.TSIG) error {
+	return ns.service.tsig.Verify(msg, t)
+}
+
+// truncate cut the udp answer to the client advertised EDNS buffer size (512 without EDNS) and set the TC bit,
+// so the client retry over tcp. the answer may be shared with the cache, so it is copied before truncate
+func (ns *NameServer) truncate(req *dns.Msg, resp *dns.Msg) *dns.Msg {
+	if "udp" != ns.server.Net {
+		return resp
+	}
+
+	var size = dns.MinMsgSize
+	if opt := req.IsEdns0(); nil != opt && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	if resp.Len() <= size {
+		return resp
+	}
+
+	resp = resp.Copy()
+	resp.Truncate(size)
+
+	return resp
+}
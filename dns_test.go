@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestNameServerTruncate(t *testing.T) {
+	var ns = &NameServer{server: &dns.Server{Net: "udp"}}
+	var resp = newTestMsg("txt.example.com.")
+	for i := 0; i < 16; i++ {
+		resp.Answer = append(resp.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: "txt.example.com.", Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300},
+			Txt: []string{strings.Repeat("x", 100)},
+		})
+	}
+
+	var req = new(dns.Msg)
+	req.SetQuestion("txt.example.com.", dns.TypeTXT)
+	if out := ns.truncate(req, resp); !out.Truncated || out.Len() > dns.MinMsgSize || 16 != len(resp.Answer) {
+		t.Errorf("answer without edns truncate to %d byte tc %v, origin answer %d", out.Len(), out.Truncated, len(resp.Answer))
+	}
+
+	req.SetEdns0(4096, false)
+	if out := ns.truncate(req, resp); out.Truncated || 16 != len(out.Answer) {
+		t.Errorf("answer within edns size should not be truncated")
+	}
+
+	ns.server.Net = "tcp"
+	req.SetEdns0(512, false)
+	if out := ns.truncate(req, resp); out.Truncated {
+		t.Errorf("tcp answer should not be truncated")
+	}
+}
+
+func TestNameServerTransfer(t *testing.T) {
+	var path = filepath.Join(t.TempDir(), "corp.zone")
+	if err := os.WriteFile(path, []byte(testZone), 0644); nil != err {
+		t.Fatal(err)
+	}
+
+	var secret = "c2VjcmV0LWtleS1vZi10cmFuc2Zlcg=="
+	var option = ZoneOption{Name: "corp.example.", File: path, Transfer: []string{"127.0.0.0/8"}, TransferKey: "xfr.key."}
+	var service = newTestService()
+	var err error
+	if service.zones, err = NewZones([]ZoneOption{option}); nil != err {
+		t.Fatal(err)
+	}
+	if service.tsig, err = NewTSIGKeys(map[string]string{"Xfr.Key": secret}); nil != err {
+		t.Fatal(err)
+	}
+
+	var handle, _ = NewNameServer(service, "tcp", "")
+	var ns = handle.(*NameServer)
+	var started = make(chan struct{})
+	ns.server.NotifyStartedFunc = func() { close(started) }
+	if ns.server.Listener, err = net.Listen("tcp", "127.0.0.1:0"); nil != err {
+		t.Fatal(err)
+	}
+	go ns.server.ActivateAndServe()
+	defer ns.Stop()
+	<-started
+
+	var transfer = func(qtype uint16, serial uint32, key string) ([]dns.RR, error) {
+		var req = new(dns.Msg)
+		if dns.TypeIXFR == qtype {
+			req.SetIxfr("corp.example.", serial, "ns1.corp.example.", "admin.corp.example.")
+		} else {
+			req.SetAxfr("corp.example.")
+		}
+		if "" != key {
+			req.SetTsig(key, dns.HmacSHA256, 300, time.Now().Unix())
+		}
+
+		var tr = &dns.Transfer{TsigSecret: map[string]string{"xfr.key.": secret, "bad.key.": "YmFk"}}
+		var ch, err = tr.In(req, ns.server.Listener.Addr().String())
+		if nil != err {
+			return nil, err
+		}
+
+		var rrs []dns.RR
+		for env := range ch {
+			if nil != env.Error {
+				return rrs, env.Error
+			}
+			rrs = append(rrs, env.RR...)
+		}
+
+		return rrs, nil
+	}
+
+	var rrs []dns.RR
+	if rrs, err = transfer(dns.TypeAXFR, 0, "xfr.key."); nil != err {
+		t.Fatal(err)
+	}
+	if 14 != len(rrs) || dns.TypeSOA != rrs[0].Header().Rrtype || dns.TypeSOA != rrs[len(rrs)-1].Header().Rrtype {
+		t.Errorf("axfr got %d record %v", len(rrs), rrs)
+	}
+
+	if rrs, err = transfer(dns.TypeIXFR, 2024010101, "xfr.key."); nil != err || 1 != len(rrs) {
+		t.Errorf("ixfr of the current serial got %v %v", rrs, err)
+	}
+	if rrs, err = transfer(dns.TypeIXFR, 2023010101, "xfr.key."); nil != err || 14 != len(rrs) {
+		t.Errorf("ixfr of the old serial got %d record %v", len(rrs), err)
+	}
+
+	// unsigned and wrong key request is refused
+	if _, err = transfer(dns.TypeAXFR, 0, ""); nil == err {
+		t.Error("axfr without tsig should be refused")
+	}
+	if _, err = transfer(dns.TypeAXFR, 0, "bad.key."); nil == err {
+		t.Error("axfr with unknown tsig key should be refused")
+	}
+
+	// client out of the acl is refused
+	if zone := service.zones.Get("corp.example."); zone.Allow(net.ParseIP("192.0.2.1"), "xfr.key.") || !zone.Allow(net.ParseIP("127.0.0.1"), "xfr.key.") {
+		t.Error("zone transfer acl mismatch")
+	}
+
+	// transfer of other listener is never forwarded
+	var req = new(dns.Msg)
+	req.SetAxfr("corp.example.")
+	if resp, err := service.Query("127.0.0.1:1", req); nil != err || dns.RcodeRefused != resp.Rcode {
+		t.Errorf("axfr query got %v %v", resp, err)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// DNS over QUIC application error code (RFC 9250 section 4.3)
+const (
+	doqNoError       quic.ApplicationErrorCode = 0
+	doqInternalError quic.ApplicationErrorCode = 1
+	doqProtocolError quic.ApplicationErrorCode = 2
+)
+
+// QUICServer DNS over QUIC server (RFC 9250)
+// every query is sent on its own stream, so a lost packet only block the query of the stream
+type QUICServer struct {
+	addr     string                  `label:"listen address"`
+	idle     time.Duration           `label:"connection idle timeout"`
+	closed   int32                   `label:"server is stopped"`
+	service  *Service                `label:"dns query service"`
+	listener *quic.Listener          `label:"quic listener"`
+	mu       *sync.Mutex             `label:"connection list lock"`
+	conns    map[*quic.Conn]struct{} `label:"active client connection"`
+}
+
+// NewQUICServer create DNS over QUIC server
+func NewQUICServer(service *Service, network string, addr string) (ReverseProxy, bool) {
+	if "quic" != network {
+		return nil, false
+	}
+
+	if !service.cert.Ready() {
+		service.Logger.Write(LevelError, " [E] quic bind %s miss tls cert and key config\n", addr)
+		return nil, false
+	}
+
+	var ns = &QUICServer{
+		addr:    addr,
+		idle:    time.Duration(service.config.TLS.IdleTimeout) * time.Second,
+		service: service,
+		mu:      new(sync.Mutex),
+		conns:   make(map[*quic.Conn]struct{}),
+	}
+
+	return ns, true
+}
+
+// Start server
+func (s *QUICServer) Start() error {
+	var listener, err = quic.ListenAddr(s.addr, s.service.cert.TLSConfig("doq"), &quic.Config{
+		MaxIdleTimeout:     s.idle,
+		MaxIncomingStreams: dotPipeline,
+	})
+	if nil != err {
+		return err
+	}
+
+	s.mu.Lock()
+	s.listener = listener
+	s.mu.Unlock()
+
+	for {
+		var conn, err = listener.Accept(context.Background())
+		if nil != err {
+			if 1 == atomic.LoadInt32(&s.closed) {
+				return nil
+			}
+
+			return err
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		go s.serve(conn)
+	}
+}
+
+// Stop server
+func (s *QUICServer) Stop() error {
+	var err error
+
+	atomic.StoreInt32(&s.closed, 1)
+
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.CloseWithError(doqNoError, "")
+	}
+	if nil != s.listener {
+		err = s.listener.Close()
+	}
+	s.mu.Unlock()
+
+	return err
+}
+
+// serve accept query stream until client close or idle timeout
+func (s *QUICServer) serve(conn *quic.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	for {
+		var stream, err = conn.AcceptStream(context.Background())
+		if nil != err {
+			return
+		}
+
+		go s.reply(conn, stream)
+	}
+}
+
+// reply read one query from the stream, query the service and write the answer to the same stream
+func (s *QUICServer) reply(conn *quic.Conn, stream *quic.Stream) {
+	var src = conn.RemoteAddr().String()
+	stream.SetDeadline(time.Now().Add(s.idle))
+
+	var req, err = readQUICMsg(stream)
+	if nil != err {
+		s.service.Logger.Write(LevelError, " [E] client %s send invalid dns message: %v\n", src, err)
+		conn.CloseWithError(doqProtocolError, err.Error())
+		return
+	}
+	// the message id must be 0 on quic stream
+	if 0 != req.Id || req.Response || 0 == len(req.Question) {
+		conn.CloseWithError(doqProtocolError, "invalid dns query")
+		return
+	}
+
+	var resp *dns.Msg
+	if resp, err = s.service.Query(src, req); nil != err {
+		s.service.Logger.Write(LevelError, " [E] client %s query %#v error: %v\n", src, req, err)
+		stream.CancelRead(quic.StreamErrorCode(doqInternalError))
+		stream.CancelWrite(quic.StreamErrorCode(doqInternalError))
+		return
+	} else if nil == resp {
+		s.service.Logger.Write(LevelError, " [E] client %s query %#v result is empty\n", src, req)
+		stream.CancelRead(quic.StreamErrorCode(doqInternalError))
+		stream.CancelWrite(quic.StreamErrorCode(doqInternalError))
+		return
+	}
+
+	// the answer may be shared by the cache or the in-flight query, reset the id of the copy
+	resp = resp.Copy()
+	resp.Id = 0
+	if err = writeQUICMsg(stream, resp); nil != err {
+		s.service.Logger.Write(LevelError, " [E] send result to client %s %#v error: %v\n", src, req, err)
+	}
+}
+
+// readQUICMsg read the 2 byte length prefixed dns message of the stream
+func readQUICMsg(stream io.Reader) (*dns.Msg, error) {
+	var head = make([]byte, 2)
+	if _, err := io.ReadFull(stream, head); nil != err {
+		return nil, err
+	}
+
+	var buf = make([]byte, binary.BigEndian.Uint16(head))
+	if _, err := io.ReadFull(stream, buf); nil != err {
+		return nil, err
+	}
+
+	var msg = new(dns.Msg)
+	if err := msg.Unpack(buf); nil != err {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// writeQUICMsg write the 2 byte length prefixed dns message and close the send side of the stream
+func writeQUICMsg(stream *quic.Stream, msg *dns.Msg) error {
+	var buf, err = msg.Pack()
+	if nil != err {
+		return err
+	}
+
+	var out = make([]byte, 2+len(buf))
+	binary.BigEndian.PutUint16(out, uint16(len(buf)))
+	copy(out[2:], buf)
+
+	if _, err = stream.Write(out); nil != err {
+		return err
+	}
+
+	return stream.Close()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestQUICServer(t *testing.T) {
+	var service = newTestService("a.example.com. 300 IN A 192.0.2.1", "b.example.com. 300 IN A 192.0.2.2")
+	service.cert = NewCertStore()
+	service.config.TLS = writeTestCert(t, "dns.test")
+	if err := service.cert.Load(service.config.TLS); nil != err {
+		t.Fatal(err)
+	}
+
+	var handle, ok = NewQUICServer(service, "quic", "127.0.0.1:0")
+	if !ok {
+		t.Fatal("create quic server failed")
+	}
+	var server = handle.(*QUICServer)
+	go server.Start()
+	defer server.Stop()
+
+	var addr string
+	for i := 0; i < 100 && "" == addr; i++ {
+		time.Sleep(10 * time.Millisecond)
+		server.mu.Lock()
+		if nil != server.listener {
+			addr = server.listener.Addr().String()
+		}
+		server.mu.Unlock()
+	}
+
+	var pem, err = os.ReadFile(service.config.TLS.Cert)
+	if nil != err {
+		t.Fatal(err)
+	}
+	var pool = x509.NewCertPool()
+	pool.AppendCertsFromPEM(pem)
+
+	var upstream Upstream
+	if upstream, err = NewUpstream("quic://"+addr+"#dns.test", time.Second); nil != err {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	upstream.(*quicUpstream).config.RootCAs = pool
+
+	// concurrent query share one connection on separate stream
+	var done = make(chan error, 2)
+	for i, host := range []string{"a.example.com.", "b.example.com."} {
+		go func(id uint16, host string) {
+			var req = new(dns.Msg)
+			req.SetQuestion(host, dns.TypeA)
+			req.Id = id
+
+			var ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			var resp, _, err = upstream.Exchange(ctx, req)
+			if nil == err && (resp.Id != id || 1 != len(resp.Answer) || resp.Answer[0].Header().Name != host) {
+				t.Errorf("quic upstream answer got %v", resp)
+			}
+			done <- err
+		}(uint16(i+1), host)
+	}
+	for i := 0; i < 2; i++ {
+		if err = <-done; nil != err {
+			t.Fatalf("quic upstream exchange error: %v", err)
+		}
+	}
+
+	// the dropped connection is dialed again
+	upstream.Close()
+	var req = new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	if _, _, err = upstream.Exchange(context.Background(), req); nil != err {
+		t.Errorf("quic upstream redial error: %v", err)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dotPipeline max number of query processing at the same time on one connection
+const dotPipeline = 64
+
+// TLSServer DNS over TLS server (RFC 7858)
+// queries on one connection are processed concurrently and the answer is sent once ready (RFC 7766 pipelining)
+type TLSServer struct {
+	addr     string                `label:"listen address"`
+	idle     time.Duration         `label:"connection idle timeout"`
+	closed   int32                 `label:"server is stopped"`
+	service  *Service              `label:"dns query service"`
+	listener net.Listener          `label:"tls listener"`
+	mu       *sync.Mutex           `label:"connection list lock"`
+	conns    map[net.Conn]struct{} `label:"active client connection"`
+}
+
+// NewTLSServer create DNS over TLS server
+func NewTLSServer(service *Service, network string, addr string) (ReverseProxy, bool) {
+	if "tls" != network {
+		return nil, false
+	}
+
+	if !service.cert.Ready() {
+		service.Logger.Write(LevelError, " [E] tls bind %s miss tls cert and key config\n", addr)
+		return nil, false
+	}
+
+	var ns = &TLSServer{
+		addr:    addr,
+		idle:    time.Duration(service.config.TLS.IdleTimeout) * time.Second,
+		service: service,
+		mu:      new(sync.Mutex),
+		conns:   make(map[net.Conn]struct{}),
+	}
+
+	return ns, true
+}
+
+// Start server
+func (s *TLSServer) Start() error {
+	var listener, err = tls.Listen("tcp", s.addr, s.service.cert.TLSConfig("dot"))
+	if nil != err {
+		return err
+	}
+
+	s.mu.Lock()
+	s.listener = listener
+	s.mu.Unlock()
+
+	for {
+		var conn, err = listener.Accept()
+		if nil != err {
+			if 1 == atomic.LoadInt32(&s.closed) {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+
+			return err
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		go s.serve(conn)
+	}
+}
+
+// Stop server
+func (s *TLSServer) Stop() error {
+	var err error
+
+	atomic.StoreInt32(&s.closed, 1)
+
+	s.mu.Lock()
+	if nil != s.listener {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	return err
+}
+
+// serve read query from the connection until client close or idle timeout
+func (s *TLSServer) serve(conn net.Conn) {
+	var wg = new(sync.WaitGroup)
+	var wmu = new(sync.Mutex)
+	var sem = make(chan struct{}, dotPipeline)
+	var head = make([]byte, 2)
+
+	defer func() {
+		wg.Wait()
+		conn.Close()
+
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	for 0 == atomic.LoadInt32(&s.closed) {
+		conn.SetReadDeadline(time.Now().Add(s.idle))
+		if _, err := io.ReadFull(conn, head); nil != err {
+			return
+		}
+
+		var buf = make([]byte, binary.BigEndian.Uint16(head))
+		if _, err := io.ReadFull(conn, buf); nil != err {
+			return
+		}
+
+		var req = new(dns.Msg)
+		if err := req.Unpack(buf); nil != err {
+			s.service.Logger.Write(LevelError, " [E] client %s send invalid dns message: %v\n", conn.RemoteAddr().String(), err)
+			return
+		}
+		if req.Response || 0 == len(req.Question) {
+			continue
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(req *dns.Msg) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			s.reply(conn, wmu, req)
+		}(req)
+	}
+}
+
+// reply query the service and write the answer to the connection
+func (s *TLSServer) reply(conn net.Conn, wmu *sync.Mutex, req *dns.Msg) {
+	var src = conn.RemoteAddr().String()
+	var resp, err = s.service.Query(src, req)
+	if nil != err {
+		s.service.Logger.Write(LevelError, " [E] client %s query %#v error: %v\n", src, req, err)
+		return
+	} else if nil == resp {
+		s.service.Logger.Write(LevelError, " [E] client %s query %#v result is empty\n", src, req)
+		return
+	}
+
+	var buf []byte
+	if buf, err = resp.Pack(); nil != err {
+		s.service.Logger.Write(LevelError, " [E] pack result to client %s %#v error: %v\n", src, req, err)
+		return
+	}
+
+	var out = make([]byte, 2+len(buf))
+	binary.BigEndian.PutUint16(out, uint16(len(buf)))
+	copy(out[2:], buf)
+
+	wmu.Lock()
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err = conn.Write(out); nil != err {
+		s.service.Logger.Write(LevelError, " [E] send result to client %s %#v error: %v\n", src, req, err)
+	}
+	wmu.Unlock()
+}
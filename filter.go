@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// filter host matching mode
+const (
+	MatchExact    = "exact"
+	MatchSuffix   = "suffix"
+	MatchContains = "contains"
+	MatchRegex    = "regex"
+)
+
+// filter answer action
+const (
+	ActionNXDomain = "nxdomain"
+	ActionRefused  = "refused"
+	ActionEmpty    = "empty"
+	ActionNull     = "null"
+)
+
+// DNSFilter dns query filter
+type DNSFilter struct {
+	Host      string         `json:"host" label:"dns query host"`
+	Type      string         `json:"type" label:"dns query type name, empty or ANY is match all type"`
+	Matching  string         `json:"matching" label:"host matching mode: exact, suffix, contains, regex"`
+	Action    string         `json:"action" label:"filter answer action: nxdomain, refused, empty, null"`
+	QueryType uint16         `json:"-" label:"dns query type, zero is match all type"`
+	pattern   *regexp.Regexp `label:"compiled regex host pattern"`
+}
+
+// Init check filter rule and fill default value
+func (f *DNSFilter) Init() error {
+	var err error
+
+	f.Matching = strings.ToLower(f.Matching)
+	if MatchRegex != f.Matching {
+		f.Host = strings.Trim(strings.ToLower(f.Host), ".")
+	}
+	if "" == f.Host {
+		return errors.New("proxy: filter rule host is empty")
+	}
+
+	f.Type = strings.ToUpper(f.Type)
+	if "" == f.Type || "ANY" == f.Type {
+		f.QueryType = 0
+	} else if qtype, ok := dns.StringToType[f.Type]; ok {
+		f.QueryType = qtype
+	} else {
+		return errors.New("proxy: filter rule " + f.Host + " not support query type " + f.Type)
+	}
+
+	switch f.Matching {
+	case "":
+		f.Matching = MatchExact
+	case MatchExact, MatchSuffix, MatchContains:
+	case MatchRegex:
+		if f.pattern, err = regexp.Compile(f.Host); nil != err {
+			return errors.New("proxy: filter rule regex " + f.Host + " compile failed, " + err.Error())
+		}
+	default:
+		return errors.New("proxy: filter rule " + f.Host + " not support matching mode " + f.Matching)
+	}
+
+	f.Action = strings.ToLower(f.Action)
+	switch f.Action {
+	case "":
+		f.Action = ActionEmpty
+	case ActionNXDomain, ActionRefused, ActionEmpty, ActionNull:
+	default:
+		return errors.New("proxy: filter rule " + f.Host + " not support action " + f.Action)
+	}
+
+	return nil
+}
+
+// Match check query host and type is match the filter rule
+// host must be lower case without the trailing dot
+func (f *DNSFilter) Match(host string, qtype uint16) bool {
+	if 0 != f.QueryType && f.QueryType != qtype {
+		return false
+	}
+
+	switch f.Matching {
+	case MatchExact:
+		return host == f.Host
+	case MatchSuffix:
+		return host == f.Host || strings.HasSuffix(host, "."+f.Host)
+	case MatchContains:
+		return strings.Contains(host, f.Host)
+	case MatchRegex:
+		return f.pattern.MatchString(host)
+	}
+
+	return false
+}
+
+// Filter dns query filter stage
+type Filter struct {
+	rules []*DNSFilter `label:"dns query filter rule list"`
+	lists []*Blocklist `label:"blocklist subscription list"`
+}
+
+// NewFilter create dns query filter from config rule, the blocklist is added by Load
+func NewFilter(rules []DNSFilter) *Filter {
+	var f = &Filter{
+		rules: make([]*DNSFilter, 0, len(rules)),
+	}
+
+	for i := range rules {
+		f.rules = append(f.rules, &rules[i])
+	}
+
+	return f
+}
+
+// Load load the blocklist file to the filter, the number of blocked domain is returned
+func (f *Filter) Load(option *BlocklistOption) (int, error) {
+	var list, err = NewBlocklist(option)
+	if nil != err {
+		return 0, err
+	}
+
+	f.lists = append(f.lists, list)
+
+	return list.Length(), nil
+}
+
+// Match find the answer action of the first filter rule or blocklist match the query, empty is not matched
+func (f *Filter) Match(name string, qtype uint16) string {
+	var host = strings.Trim(strings.ToLower(name), ".")
+
+	for _, rule := range f.rules {
+		if rule.Match(host, qtype) {
+			return rule.Action
+		}
+	}
+
+	for _, list := range f.lists {
+		if list.Match(host) {
+			return list.action
+		}
+	}
+
+	return ""
+}
+
+// Empty filter has no rule and blocklist
+func (f *Filter) Empty() bool {
+	return 0 == len(f.rules) && 0 == len(f.lists)
+}
+
+// filterAnswer build the filter action answer message
+func filterAnswer(req *dns.Msg, action string, ttl uint32) *dns.Msg {
+	var resp = new(dns.Msg)
+	var question = req.Question[0]
+
+	resp.SetReply(req)
+	resp.RecursionAvailable = true
+
+	switch action {
+	case ActionNXDomain:
+		resp.Rcode = dns.RcodeNameError
+	case ActionRefused:
+		resp.Rcode = dns.RcodeRefused
+	case ActionNull:
+		var hdr = dns.RR_Header{
+			Name:   question.Name,
+			Rrtype: question.Qtype,
+			Class:  question.Qclass,
+			Ttl:    ttl,
+		}
+
+		if dns.TypeA == question.Qtype {
+			resp.Answer = []dns.RR{&dns.A{Hdr: hdr, A: net.IPv4zero}}
+		} else if dns.TypeAAAA == question.Qtype {
+			resp.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: net.IPv6zero}}
+		}
+	}
+
+	return resp
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestFilterMatch(t *testing.T) {
+	var rules = []DNSFilter{
+		{Host: "ads.example.com", Matching: "exact", Action: "nxdomain"},
+		{Host: "tracker.net", Matching: "suffix", Action: "null"},
+		{Host: "facebook.com", Type: "AAAA", Matching: "contains"},
+		{Host: `^ad[0-9]+\.`, Matching: "regex", Action: "refused"},
+	}
+	for i := range rules {
+		if err := rules[i].Init(); nil != err {
+			t.Fatal(err)
+		}
+	}
+
+	var filter = NewFilter(rules)
+
+	var cases = []struct {
+		name   string
+		qtype  uint16
+		action string
+	}{
+		{"ads.example.com.", dns.TypeA, ActionNXDomain},
+		{"www.ads.example.com.", dns.TypeA, ""},
+		{"tracker.net.", dns.TypeA, ActionNull},
+		{"a.b.Tracker.NET.", dns.TypeAAAA, ActionNull},
+		{"mytracker.net.", dns.TypeA, ""},
+		{"www.facebook.com.", dns.TypeAAAA, ActionEmpty},
+		{"www.facebook.com.", dns.TypeA, ""},
+		{"ad12.example.org.", dns.TypeMX, ActionRefused},
+	}
+
+	for _, c := range cases {
+		if action := filter.Match(c.name, c.qtype); action != c.action {
+			t.Errorf("filter %s %s got action %q, want %q", c.name, dns.TypeToString[c.qtype], action, c.action)
+		}
+	}
+}
+
+func TestFilterInitError(t *testing.T) {
+	var rules = []DNSFilter{
+		{Host: ""},
+		{Host: "example.com", Type: "BOGUS"},
+		{Host: "example.com", Matching: "glob"},
+		{Host: "example.com", Action: "drop"},
+		{Host: "([", Matching: "regex"},
+	}
+
+	for _, rule := range rules {
+		if err := rule.Init(); nil == err {
+			t.Errorf("filter rule %#v init should failed", rule)
+		}
+	}
+}
+
+func TestFilterAnswer(t *testing.T) {
+	var req = new(dns.Msg)
+	req.SetQuestion("ads.example.com.", dns.TypeAAAA)
+
+	var resp = filterAnswer(req, ActionNull, 60)
+	if dns.RcodeSuccess != resp.Rcode || 1 != len(resp.Answer) {
+		t.Fatalf("null answer is unexpected: %v", resp)
+	}
+	if aaaa, ok := resp.Answer[0].(*dns.AAAA); !ok || !aaaa.AAAA.IsUnspecified() {
+		t.Errorf("null answer record is unexpected: %v", resp.Answer[0])
+	}
+
+	resp = filterAnswer(req, ActionNXDomain, 60)
+	if dns.RcodeNameError != resp.Rcode || 0 != len(resp.Answer) || resp.Id != req.Id {
+		t.Errorf("nxdomain answer is unexpected: %v", resp)
+	}
+}
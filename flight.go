@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// FlightStats in-flight query coalesce statistics
+type FlightStats struct {
+	Queries uint64 `json:"queries" label:"upstream query executed"`
+	Shared  uint64 `json:"shared" label:"query served by other in-flight upstream query"`
+}
+
+// flightCall in-flight upstream query
+type flightCall struct {
+	wg   *sync.WaitGroup `label:"wait the upstream query finish"`
+	item *CacheItem      `label:"upstream query result"`
+	err  error           `label:"upstream query error"`
+}
+
+// Flight coalesce identical in-flight upstream query, so one upstream query serve all waiter
+type Flight struct {
+	mu      *sync.Mutex            `label:"in-flight query lock"`
+	calls   map[string]*flightCall `label:"in-flight query by cache key"`
+	queries uint64                 `label:"upstream query executed"`
+	shared  uint64                 `label:"query served by other in-flight upstream query"`
+}
+
+// NewFlight create in-flight query coalesce
+func NewFlight() *Flight {
+	return &Flight{
+		mu:    new(sync.Mutex),
+		calls: make(map[string]*flightCall),
+	}
+}
+
+// Do execute fn only once for the same key at the same time
+// shared is true when the result is from the fn of other caller, the result must be copied before modify
+func (f *Flight) Do(key string, fn func() (*CacheItem, error)) (*CacheItem, bool, error) {
+	f.mu.Lock()
+	if call, ok := f.calls[key]; ok {
+		f.mu.Unlock()
+
+		call.wg.Wait()
+		atomic.AddUint64(&f.shared, 1)
+
+		return call.item, true, call.err
+	}
+
+	var call = &flightCall{wg: new(sync.WaitGroup)}
+	call.wg.Add(1)
+	f.calls[key] = call
+	f.mu.Unlock()
+
+	defer func() {
+		f.mu.Lock()
+		delete(f.calls, key)
+		f.mu.Unlock()
+
+		call.wg.Done()
+	}()
+
+	atomic.AddUint64(&f.queries, 1)
+	call.item, call.err = fn()
+
+	return call.item, false, call.err
+}
+
+// Stats get in-flight query coalesce statistics
+func (f *Flight) Stats() *FlightStats {
+	return &FlightStats{
+		Queries: atomic.LoadUint64(&f.queries),
+		Shared:  atomic.LoadUint64(&f.shared),
+	}
+}
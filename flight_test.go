@@ -0,0 +1,42 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlightDo(t *testing.T) {
+	var calls int64
+	var flight = NewFlight()
+	var wg = new(sync.WaitGroup)
+	var start = make(chan struct{})
+	var item = &CacheItem{Msg: newTestMsg("a.example.com.", "a.example.com. 300 IN A 192.0.2.1")}
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			<-start
+			var ret, _, err = flight.Do("a", func() (*CacheItem, error) {
+				atomic.AddInt64(&calls, 1)
+				time.Sleep(50 * time.Millisecond)
+
+				return item, nil
+			})
+			if nil != err || ret != item {
+				t.Errorf("flight result got %v %v", ret, err)
+			}
+		}()
+	}
+
+	close(start)
+	wg.Wait()
+
+	var stats = flight.Stats()
+	if calls != int64(stats.Queries) || 10 != stats.Queries+stats.Shared || stats.Shared < 1 {
+		t.Errorf("flight coalesce %d call, stats %+v", calls, stats)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// healthAlpha weight of the newest sample in the latency moving average
+const healthAlpha = 0.3
+
+// HealthStats forwarder health statistics
+type HealthStats struct {
+	Address string  `json:"address" label:"forwarder config address"`
+	Healthy bool    `json:"healthy" label:"forwarder is used by query"`
+	Success uint64  `json:"success" label:"success query count"`
+	Failure uint64  `json:"failure" label:"failed query count"`
+	Fails   int     `json:"fails" label:"consecutive failed query count"`
+	Latency float64 `json:"latency_ms" label:"moving average latency in millisecond"`
+	Ejects  uint64  `json:"ejects" label:"ejected count"`
+	Retry   int64   `json:"retry,omitempty" label:"unix time of next probe when ejected"`
+}
+
+// upstreamHealth health state of one forwarder
+type upstreamHealth struct {
+	upstream Upstream      `label:"forwarder transport"`
+	success  uint64        `label:"success query count"`
+	failure  uint64        `label:"failed query count"`
+	fails    int           `label:"consecutive failed query count"`
+	latency  time.Duration `label:"moving average latency"`
+	ejects   uint64        `label:"ejected count"`
+	backoff  time.Duration `label:"current probe backoff, zero is healthy"`
+	retry    time.Time     `label:"time of next probe"`
+	timeout  time.Duration `label:"probe query timeout"`
+}
+
+// HealthChecker track forwarder success, failure and latency
+// forwarder is ejected after consecutive failure, and re-probed in background with the canary name,
+// the probe interval is doubled on every failed probe until the max backoff
+type HealthChecker struct {
+	Fails      int                          `label:"consecutive failure to eject forwarder, zero is never eject"`
+	Backoff    time.Duration                `label:"first probe interval of ejected forwarder"`
+	MaxBackoff time.Duration                `label:"max probe interval of ejected forwarder"`
+	Canary     string                       `label:"canary query name of probe"`
+	mu         *sync.Mutex                  `label:"health state lock"`
+	states     map[Upstream]*upstreamHealth `label:"health state of forwarder"`
+	order      []*upstreamHealth            `label:"health state in config order"`
+	done       chan struct{}                `label:"stop background probe"`
+}
+
+// NewHealthChecker create forwarder health checker
+func NewHealthChecker(fails int, backoff time.Duration, maxBackoff time.Duration, canary string) *HealthChecker {
+	return &HealthChecker{
+		Fails:      fails,
+		Backoff:    backoff,
+		MaxBackoff: maxBackoff,
+		Canary:     dns.Fqdn(canary),
+		mu:         new(sync.Mutex),
+		states:     make(map[Upstream]*upstreamHealth),
+		done:       make(chan struct{}),
+	}
+}
+
+// Add track the forwarder, timeout is the probe query timeout
+func (h *HealthChecker) Add(upstream Upstream, timeout time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.states[upstream]; !ok {
+		var state = &upstreamHealth{upstream: upstream, timeout: timeout}
+		h.states[upstream] = state
+		h.order = append(h.order, state)
+	}
+}
+
+// Healthy check the forwarder is not ejected
+func (h *HealthChecker) Healthy(upstream Upstream) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var state, ok = h.states[upstream]
+
+	return !ok || 0 == state.backoff
+}
+
+// Latency get the moving average latency of the forwarder, zero is not measured
+func (h *HealthChecker) Latency(upstream Upstream) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if state, ok := h.states[upstream]; ok {
+		return state.latency
+	}
+
+	return 0
+}
+
+// Filter get the healthy forwarder, all forwarder is returned when every forwarder is ejected
+// so the query is never failed by the checker itself
+func (h *HealthChecker) Filter(upstreams []Upstream) []Upstream {
+	var healthy = make([]Upstream, 0, len(upstreams))
+	for _, upstream := range upstreams {
+		if h.Healthy(upstream) {
+			healthy = append(healthy, upstream)
+		}
+	}
+	if 0 == len(healthy) {
+		return upstreams
+	}
+
+	return healthy
+}
+
+// Record record the query result of the forwarder, the forwarder is ejected when the consecutive failure reach the limit
+func (h *HealthChecker) Record(upstream Upstream, rtt time.Duration, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var state, ok = h.states[upstream]
+	if !ok {
+		return
+	}
+
+	if nil == err {
+		state.success++
+		state.fails = 0
+		if 0 == state.latency {
+			state.latency = rtt
+		} else {
+			state.latency = time.Duration(healthAlpha*float64(rtt) + (1-healthAlpha)*float64(state.latency))
+		}
+
+		return
+	}
+
+	state.failure++
+	state.fails++
+	if h.Fails > 0 && state.fails >= h.Fails && 0 == state.backoff {
+		state.ejects++
+		state.backoff = h.Backoff
+		state.retry = time.Now().Add(state.backoff)
+
+		go h.probe(state)
+	}
+}
+
+// Stats get health statistics of every forwarder
+func (h *HealthChecker) Stats() []HealthStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var stats = make([]HealthStats, 0, len(h.order))
+	for _, state := range h.order {
+		var item = HealthStats{
+			Address: state.upstream.Address(),
+			Healthy: 0 == state.backoff,
+			Success: state.success,
+			Failure: state.failure,
+			Fails:   state.fails,
+			Latency: float64(state.latency) / float64(time.Millisecond),
+			Ejects:  state.ejects,
+		}
+		if 0 != state.backoff {
+			item.Retry = state.retry.Unix()
+		}
+
+		stats = append(stats, item)
+	}
+
+	return stats
+}
+
+// Close stop the background probe
+func (h *HealthChecker) Close() {
+	close(h.done)
+}
+
+// probe query the canary name after backoff until the ejected forwarder answer
+func (h *HealthChecker) probe(state *upstreamHealth) {
+	for {
+		h.mu.Lock()
+		var wait = time.Until(state.retry)
+		h.mu.Unlock()
+
+		var timer = time.NewTimer(wait)
+		select {
+		case <-h.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		var req = new(dns.Msg)
+		req.SetQuestion(h.Canary, dns.TypeNS)
+
+		var ctx, cancel = context.WithTimeout(context.Background(), state.timeout)
+		var resp, rtt, err = state.upstream.Exchange(ctx, req)
+		cancel()
+
+		h.mu.Lock()
+		if nil == err && dns.RcodeServerFailure != resp.Rcode && dns.RcodeRefused != resp.Rcode {
+			state.fails = 0
+			state.backoff = 0
+			state.latency = rtt
+			h.mu.Unlock()
+
+			return
+		}
+
+		state.backoff *= 2
+		if state.backoff > h.MaxBackoff {
+			state.backoff = h.MaxBackoff
+		}
+		state.retry = time.Now().Add(state.backoff)
+		h.mu.Unlock()
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testUpstream forwarder answer every query by the rcode, fail by the down flag or never answer by the block flag
+type testUpstream struct {
+	addr   string
+	down   int32
+	block  int32
+	rcode  int32
+	probes int32
+}
+
+func (u *testUpstream) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+	if "." == req.Question[0].Name {
+		atomic.AddInt32(&u.probes, 1)
+	}
+	if 1 == atomic.LoadInt32(&u.down) {
+		return nil, 0, errors.New("forwarder is down")
+	}
+	if 1 == atomic.LoadInt32(&u.block) {
+		<-ctx.Done()
+		return nil, 0, ctx.Err()
+	}
+
+	var resp = new(dns.Msg)
+	resp.SetRcode(req, int(atomic.LoadInt32(&u.rcode)))
+
+	return resp, time.Millisecond, nil
+}
+
+func (u *testUpstream) Address() string {
+	return u.addr
+}
+
+func (u *testUpstream) Close() {}
+
+func TestHealthChecker(t *testing.T) {
+	var a = &testUpstream{addr: "a", down: 1}
+	var b = &testUpstream{addr: "b"}
+	var health = NewHealthChecker(3, 20*time.Millisecond, 40*time.Millisecond, ".")
+	defer health.Close()
+	health.Add(a, time.Second)
+	health.Add(b, time.Second)
+
+	var all = []Upstream{a, b}
+	for i := 0; i < 3; i++ {
+		if 2 != len(health.Filter(all)) {
+			t.Fatalf("forwarder ejected after %d failure", i)
+		}
+		health.Record(a, 0, errors.New("timeout"))
+	}
+	if health.Healthy(a) || 1 != len(health.Filter(all)) {
+		t.Fatal("forwarder should be ejected after 3 consecutive failure")
+	}
+	if ret := health.Filter([]Upstream{a}); 1 != len(ret) {
+		t.Error("every forwarder is ejected should fall back to all forwarder")
+	}
+
+	health.Record(b, 10*time.Millisecond, nil)
+	health.Record(b, 20*time.Millisecond, nil)
+	var stats = health.Stats()
+	if "a" != stats[0].Address || stats[0].Healthy || 3 != stats[0].Fails || 1 != stats[0].Ejects || 0 == stats[0].Retry {
+		t.Errorf("ejected forwarder stats got %+v", stats[0])
+	}
+	if !stats[1].Healthy || 2 != stats[1].Success || 13 != int(stats[1].Latency) {
+		t.Errorf("healthy forwarder stats got %+v", stats[1])
+	}
+
+	// failed probe keep the forwarder ejected, the recovered forwarder is used again
+	time.Sleep(50 * time.Millisecond)
+	if health.Healthy(a) || 0 == atomic.LoadInt32(&a.probes) {
+		t.Fatal("forwarder should be probed and kept ejected")
+	}
+	atomic.StoreInt32(&a.down, 0)
+	for i := 0; i < 20 && !health.Healthy(a); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !health.Healthy(a) {
+		t.Error("recovered forwarder should be healthy after probe")
+	}
+}
@@ -1,14 +1,21 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"io"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
+// dohMediaType DNS over HTTPS message media type (RFC 8484)
+const dohMediaType = "application/dns-message"
+
 // HTTPServer http dns server
 type HTTPServer struct {
 	net     string
@@ -32,6 +39,11 @@ func NewHTTPServer(service *Service, net string, addr string) (ReverseProxy, boo
 		return nil, flag
 	}
 
+	if "https" == net && !service.cert.Ready() {
+		service.Logger.Write(LevelError, " [E] https bind %s miss tls cert and key config\n", addr)
+		return nil, false
+	}
+
 	var ns = &HTTPServer{
 		net:     net,
 		service: service,
@@ -51,15 +63,89 @@ func NewHTTPServer(service *Service, net string, addr string) (ReverseProxy, boo
 func (s *HTTPServer) Start() error {
 	var mux = http.NewServeMux()
 	mux.HandleFunc("/", s.resolveDNS)
+	mux.HandleFunc("/stats", s.stats)
+	mux.HandleFunc("/dns-query", s.dnsQuery)
 
 	s.server.Handler = mux
 
+	if "https" == s.net {
+		s.server.TLSConfig = s.service.cert.TLSConfig("h2", "http/1.1")
+
+		return s.server.ListenAndServeTLS("", "")
+	}
+
 	return s.server.ListenAndServe()
 }
 
 // Stop server
 func (s *HTTPServer) Stop() error {
-	return s.server.Shutdown(nil)
+	return s.server.Shutdown(context.Background())
+}
+
+// dnsQuery DNS over HTTPS endpoint (RFC 8484)
+// GET with base64url dns parameter and POST with application/dns-message body are supported
+func (s *HTTPServer) dnsQuery(w http.ResponseWriter, req *http.Request) {
+	var err error
+	var buf []byte
+
+	switch req.Method {
+	case http.MethodGet:
+		var param = strings.TrimRight(req.URL.Query().Get("dns"), "=")
+		if "" == param {
+			http.Error(w, "miss dns parameter", http.StatusBadRequest)
+			return
+		}
+		if buf, err = base64.RawURLEncoding.DecodeString(param); nil != err {
+			http.Error(w, "dns parameter is not base64url, "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if dohMediaType != req.Header.Get("Content-Type") {
+			http.Error(w, "content type must be "+dohMediaType, http.StatusUnsupportedMediaType)
+			return
+		}
+		if buf, err = io.ReadAll(io.LimitReader(req.Body, dns.MaxMsgSize+1)); nil != err {
+			http.Error(w, "read dns message failed, "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(buf) > dns.MaxMsgSize {
+			http.Error(w, "dns message is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var msg = new(dns.Msg)
+	if err = msg.Unpack(buf); nil != err || msg.Response || 1 != len(msg.Question) {
+		http.Error(w, "invalid dns query message", http.StatusBadRequest)
+		return
+	}
+
+	var resp *dns.Msg
+	if resp, err = s.service.Query(req.RemoteAddr, msg); nil != err || nil == resp {
+		s.service.Logger.Write(LevelError, " [E] client %s query %#v error: %v\n", req.RemoteAddr, msg, err)
+
+		resp = new(dns.Msg)
+		resp.SetRcode(msg, dns.RcodeServerFailure)
+	}
+
+	if buf, err = resp.Pack(); nil != err {
+		s.service.Logger.Write(LevelError, " [E] client %s pack query %v result failed: %v\n", req.RemoteAddr, msg, err)
+		http.Error(w, "pack dns message failed", http.StatusInternalServerError)
+		return
+	}
+
+	var ttl, _ = recordTTL(resp)
+	if dns.RcodeServerFailure == resp.Rcode {
+		ttl = 0
+	}
+
+	w.Header().Set("Content-Type", dohMediaType)
+	w.Header().Set("Cache-Control", "max-age="+strconv.FormatInt(ttl, 10))
+	w.Write(buf)
 }
 
 // resolveDNS process dns query
@@ -108,3 +194,15 @@ func (s *HTTPServer) resolveDNS(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 }
+
+// stats show dns proxy runtime statistics
+func (s *HTTPServer) stats(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	if retByte, err := json.Marshal(s.service.Stats()); err != nil {
+		w.Write([]byte("{\"code\":1003, \"message\":\"serialize stats failed, " + err.Error() + "\"}"))
+		s.service.Logger.Write(LevelError, " [E] client %s serialize stats failed: %v\n", req.RemoteAddr, err)
+	} else {
+		w.Write(retByte)
+	}
+}
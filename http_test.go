@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestHTTPServerDNSQuery(t *testing.T) {
+	var server = &HTTPServer{net: "http", service: newTestService("www.example.com. 300 IN A 192.0.2.1")}
+	var query = new(dns.Msg)
+	query.SetQuestion("www.example.com.", dns.TypeA)
+	query.Id = 0
+
+	var buf, err = query.Pack()
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	var cases = []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(buf), nil),
+		httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(buf)),
+	}
+	cases[1].Header.Set("Content-Type", dohMediaType)
+
+	for _, req := range cases {
+		var w = httptest.NewRecorder()
+		server.dnsQuery(w, req)
+
+		if http.StatusOK != w.Code || dohMediaType != w.Header().Get("Content-Type") {
+			t.Fatalf("%s dns query got status %d content type %s", req.Method, w.Code, w.Header().Get("Content-Type"))
+		}
+		if "max-age=300" != w.Header().Get("Cache-Control") {
+			t.Errorf("%s dns query got cache control %s, want max-age=300", req.Method, w.Header().Get("Cache-Control"))
+		}
+
+		var resp = new(dns.Msg)
+		if err = resp.Unpack(w.Body.Bytes()); nil != err || 1 != len(resp.Answer) || 0 != resp.Id {
+			t.Errorf("%s dns query got answer %v %v", req.Method, resp, err)
+		}
+	}
+
+	var bad = []struct {
+		req  *http.Request
+		code int
+	}{
+		{httptest.NewRequest(http.MethodGet, "/dns-query", nil), http.StatusBadRequest},
+		{httptest.NewRequest(http.MethodGet, "/dns-query?dns=%%%", nil), http.StatusBadRequest},
+		{httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(buf)), http.StatusUnsupportedMediaType},
+		{httptest.NewRequest(http.MethodPut, "/dns-query", bytes.NewReader(buf)), http.StatusMethodNotAllowed},
+	}
+	for _, c := range bad {
+		var w = httptest.NewRecorder()
+		server.dnsQuery(w, c.req)
+
+		if c.code != w.Code {
+			t.Errorf("%s %s got status %d, want %d", c.req.Method, c.req.URL, w.Code, c.code)
+		}
+	}
+}
@@ -17,6 +17,12 @@ var ErrCacheExpire = errors.New("cache item expire")
 // ErrCacheTimeout dns cache timeout
 var ErrCacheTimeout = errors.New("remote cache timeout")
 
+// ErrForwarderFailed every forwarder of the group failed
+var ErrForwarderFailed = errors.New("all forwarder failed")
+
+// ErrForwarderRcode forwarder answer SERVFAIL or REFUSED, it is the failure of the forwarder
+var ErrForwarderRcode = errors.New("forwarder answer server failure or refused")
+
 var page = []byte(`
 	<html lang=en>
 	<head>
@@ -90,5 +96,7 @@ func init() {
 	provider = map[string]ProxyHandle{
 		"http": NewHTTPServer,
 		"raw":  NewNameServer,
+		"tls":  NewTLSServer,
+		"quic": NewQUICServer,
 	}
 }
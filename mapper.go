@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// mapperChain max number of CNAME followed in one answer
+const mapperChain = 8
+
+// Mapper local domain record mapper, the entry is one of
+// domain:value, the value is an ip for A or AAAA record, or a domain for CNAME record, the ttl is the default ttl
+// zone file record like "www.example.com. 300 IN MX 10 mail.example.com.", every record type is supported
+// the domain with leading dot match itself and all subdomain, the domain with leading *. match all subdomain only
+type Mapper struct {
+	ttl      uint32              `label:"default ttl of domain:value entry"`
+	exact    map[string][]dns.RR `label:"record of the domain"`
+	suffix   map[string][]dns.RR `label:"record of the domain and all subdomain"`
+	wildcard map[string][]dns.RR `label:"record of all subdomain"`
+}
+
+// NewMapper compile the mapper entry, the same domain can have multiple entry
+func NewMapper(rules []string, ttl uint32) (*Mapper, error) {
+	var m = &Mapper{
+		ttl:      ttl,
+		exact:    make(map[string][]dns.RR),
+		suffix:   make(map[string][]dns.RR),
+		wildcard: make(map[string][]dns.RR),
+	}
+
+	for _, rule := range rules {
+		if err := m.Add(rule); nil != err {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// Add add mapper entry
+func (m *Mapper) Add(rule string) error {
+	var rr dns.RR
+	var name string
+	var line = strings.TrimSpace(rule)
+
+	if strings.ContainsAny(line, " \t") {
+		// the leading . of the suffix entry is not a valid owner name, the marker is removed before parse and added back
+		var err error
+		var marker string
+		if strings.HasPrefix(line, "*.") {
+			marker, line = "*.", line[2:]
+		} else if strings.HasPrefix(line, ".") {
+			marker, line = ".", line[1:]
+		}
+		if rr, err = dns.NewRR(line); nil != err || nil == rr {
+			return errors.New("proxy: mapper record " + rule + " is invalid")
+		}
+		name = marker + strings.ToLower(rr.Header().Name)
+		if "*." == marker {
+			rr.Header().Name = name
+		}
+	} else {
+		var val = strings.SplitN(line, ":", 2)
+		if 2 != len(val) || "" == val[1] {
+			return errors.New("proxy: mapper rule format is domain:value, give " + rule)
+		}
+
+		name = dns.Fqdn(strings.ToLower(val[0]))
+		var hdr = dns.RR_Header{Name: strings.TrimPrefix(name, "."), Class: dns.ClassINET, Ttl: m.ttl}
+		if ip := net.ParseIP(val[1]); nil == ip {
+			if _, ok := dns.IsDomainName(val[1]); !ok {
+				return errors.New("proxy: mapper value " + val[1] + " is not ip or domain")
+			}
+			hdr.Rrtype = dns.TypeCNAME
+			rr = &dns.CNAME{Hdr: hdr, Target: dns.Fqdn(strings.ToLower(val[1]))}
+		} else if ip4 := ip.To4(); nil != ip4 {
+			hdr.Rrtype = dns.TypeA
+			rr = &dns.A{Hdr: hdr, A: ip4}
+		} else {
+			hdr.Rrtype = dns.TypeAAAA
+			rr = &dns.AAAA{Hdr: hdr, AAAA: ip}
+		}
+	}
+
+	var set = m.exact
+	if strings.HasPrefix(name, "*.") {
+		set, name = m.wildcard, name[2:]
+	} else if strings.HasPrefix(name, ".") {
+		set, name = m.suffix, name[1:]
+	}
+	if _, ok := dns.IsDomainName(name); "" == name || "." == name || !ok {
+		return errors.New("proxy: mapper domain " + rule + " is invalid")
+	}
+
+	set[name] = append(set[name], rr)
+
+	return nil
+}
+
+// Lookup get the record of the domain, the most specific entry is used
+func (m *Mapper) Lookup(name string) ([]dns.RR, bool) {
+	name = dns.Fqdn(strings.ToLower(name))
+	if rrs, ok := m.exact[name]; ok {
+		return rrs, true
+	}
+	if rrs, ok := m.suffix[name]; ok {
+		return rrs, true
+	}
+
+	for off, end := 0, false; !end; {
+		if off, end = dns.NextLabel(name, off); end {
+			break
+		}
+
+		var parent = name[off:]
+		if rrs, ok := m.wildcard[parent]; ok {
+			return rrs, true
+		}
+		if rrs, ok := m.suffix[parent]; ok {
+			return rrs, true
+		}
+	}
+
+	return nil, false
+}
+
+// Answer answer the query by the mapper record, ErrNotFound is returned when the domain is not mapped
+// the CNAME target is followed when it is also mapped, the domain without the query type record is NODATA
+func (m *Mapper) Answer(req *dns.Msg) (*dns.Msg, error) {
+	var q = req.Question[0]
+	var rrs, ok = m.Lookup(q.Name)
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	var resp = new(dns.Msg)
+	resp.SetReply(req)
+	resp.Authoritative = true
+
+	var name = q.Name
+	var seen = make(map[string]bool)
+	for i := 0; i < mapperChain && ok && !seen[strings.ToLower(name)]; i++ {
+		seen[strings.ToLower(name)] = true
+
+		var target string
+		for _, rr := range rrs {
+			if q.Qtype == rr.Header().Rrtype || dns.TypeANY == q.Qtype {
+				resp.Answer = append(resp.Answer, mapperRecord(rr, name))
+			} else if cname, isCNAME := rr.(*dns.CNAME); isCNAME && "" == target {
+				resp.Answer = append(resp.Answer, mapperRecord(rr, name))
+				target = cname.Target
+			}
+		}
+		if "" == target {
+			break
+		}
+
+		name = target
+		rrs, ok = m.Lookup(name)
+	}
+
+	return resp, nil
+}
+
+// Addresses get the A and AAAA record of the exact and suffix entry with the mapped domain as owner name, ordered by the domain
+func (m *Mapper) Addresses() []dns.RR {
+	var ret []dns.RR
+	for _, set := range []map[string][]dns.RR{m.exact, m.suffix} {
+		var names = make([]string, 0, len(set))
+		for name := range set {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			for _, rr := range set[name] {
+				if dns.TypeA == rr.Header().Rrtype || dns.TypeAAAA == rr.Header().Rrtype {
+					ret = append(ret, mapperRecord(rr, name))
+				}
+			}
+		}
+	}
+
+	return ret
+}
+
+// mapperRecord copy the record with the query name, so the suffix and wildcard record answer the exact name
+func mapperRecord(rr dns.RR, name string) dns.RR {
+	var ret = dns.Copy(rr)
+	ret.Header().Name = name
+
+	return ret
+}
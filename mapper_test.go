@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestMapperAnswer(t *testing.T) {
+	var mapper, err = NewMapper([]string{
+		"www.imohe.com:192.168.1.1",
+		"www.imohe.com:192.168.1.11",
+		"www.imohe.com:fd00::1",
+		".demo.imohe.com:192.168.1.2",
+		"git.imohe.com:www.imohe.com",
+		"loop-a.imohe.com:loop-b.imohe.com",
+		"loop-b.imohe.com:loop-a.imohe.com",
+		"imohe.com. 600 IN MX 10 mail.imohe.com.",
+		`imohe.com. 600 IN TXT "v=spf1 -all"`,
+		"_sip._tcp.imohe.com. 600 IN SRV 10 60 5060 sip.imohe.com.",
+		"1.1.168.192.in-addr.arpa. 600 IN PTR www.imohe.com.",
+		"*.wild.imohe.com. 60 IN A 192.168.1.3",
+		".zone.imohe.com. 60 IN A 192.168.1.4",
+		"*.zone-wild.imohe.com 60 IN AAAA fd00::4",
+	}, 60)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	var cases = []struct {
+		name  string
+		qtype uint16
+		want  []uint16
+	}{
+		{"www.imohe.com.", dns.TypeA, []uint16{dns.TypeA, dns.TypeA}},
+		{"WWW.imohe.com.", dns.TypeAAAA, []uint16{dns.TypeAAAA}},
+		{"www.imohe.com.", dns.TypeMX, nil},
+		{"demo.imohe.com.", dns.TypeA, []uint16{dns.TypeA}},
+		{"a.b.demo.imohe.com.", dns.TypeA, []uint16{dns.TypeA}},
+		{"git.imohe.com.", dns.TypeA, []uint16{dns.TypeCNAME, dns.TypeA, dns.TypeA}},
+		{"git.imohe.com.", dns.TypeCNAME, []uint16{dns.TypeCNAME}},
+		{"loop-a.imohe.com.", dns.TypeA, []uint16{dns.TypeCNAME, dns.TypeCNAME}},
+		{"imohe.com.", dns.TypeMX, []uint16{dns.TypeMX}},
+		{"imohe.com.", dns.TypeTXT, []uint16{dns.TypeTXT}},
+		{"_sip._tcp.imohe.com.", dns.TypeSRV, []uint16{dns.TypeSRV}},
+		{"1.1.168.192.in-addr.arpa.", dns.TypePTR, []uint16{dns.TypePTR}},
+		{"x.wild.imohe.com.", dns.TypeA, []uint16{dns.TypeA}},
+		{"zone.imohe.com.", dns.TypeA, []uint16{dns.TypeA}},
+		{"a.b.zone.imohe.com.", dns.TypeA, []uint16{dns.TypeA}},
+		{"x.zone-wild.imohe.com.", dns.TypeAAAA, []uint16{dns.TypeAAAA}},
+	}
+	for _, c := range cases {
+		var req = new(dns.Msg)
+		req.SetQuestion(c.name, c.qtype)
+
+		var resp, err = mapper.Answer(req)
+		if nil != err {
+			t.Errorf("mapper %s %s error: %v", c.name, dns.TypeToString[c.qtype], err)
+			continue
+		}
+		if len(resp.Answer) != len(c.want) || !resp.Response || resp.Id != req.Id {
+			t.Errorf("mapper %s %s answer got %v", c.name, dns.TypeToString[c.qtype], resp.Answer)
+			continue
+		}
+		for i, rr := range resp.Answer {
+			if rr.Header().Rrtype != c.want[i] {
+				t.Errorf("mapper %s %s answer %d got %s", c.name, dns.TypeToString[c.qtype], i, rr)
+			}
+		}
+	}
+
+	var req = new(dns.Msg)
+	req.SetQuestion("x.wild.imohe.com.", dns.TypeA)
+	if resp, _ := mapper.Answer(req); "x.wild.imohe.com." != resp.Answer[0].Header().Name || 60 != resp.Answer[0].Header().Ttl {
+		t.Errorf("wildcard answer should use the query name, got %s", resp.Answer[0])
+	}
+	req.SetQuestion("a.b.zone.imohe.com.", dns.TypeA)
+	if resp, _ := mapper.Answer(req); "a.b.zone.imohe.com." != resp.Answer[0].Header().Name {
+		t.Errorf("zone format suffix answer should use the query name, got %s", resp.Answer[0])
+	}
+	for _, name := range []string{"wild.imohe.com.", "mail.imohe.com.", "a.www.imohe.com.", "zone-wild.imohe.com."} {
+		req.SetQuestion(name, dns.TypeA)
+		if _, err = mapper.Answer(req); ErrNotFound != err {
+			t.Errorf("mapper %s should not be mapped", name)
+		}
+	}
+
+	for _, rule := range []string{"www.imohe.com", "www.imohe.com:", "www.imohe.com:not a domain", "www.imohe.com. IN BAD 1", ". 60 IN A 192.168.1.5", "*. 60 IN A 192.168.1.5"} {
+		if _, err = NewMapper([]string{rule}, 60); nil == err {
+			t.Errorf("invalid mapper %q should failed", rule)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// PrefetchStats dns cache prefetch statistics
+type PrefetchStats struct {
+	Triggered uint64 `json:"triggered" label:"prefetch triggered count"`
+	Refreshed uint64 `json:"refreshed" label:"cache item refreshed by prefetch"`
+	Failed    uint64 `json:"failed" label:"prefetch upstream query failed count"`
+	Skipped   uint64 `json:"skipped" label:"prefetch skipped by concurrency limit"`
+	Saved     uint64 `json:"saved" label:"client upstream query saved by prefetched cache item"`
+}
+
+// Prefetcher refresh frequently queried cache item in background before it expire
+type Prefetcher struct {
+	Percent   int64               `label:"trigger prefetch when the percent of cache ttl has elapsed"`
+	Threshold int64               `label:"min hit count of cache item to trigger prefetch, negative is disable prefetch"`
+	service   *Service            `label:"dns query service"`
+	sem       chan struct{}       `label:"prefetch concurrency limit"`
+	mu        *sync.Mutex         `label:"pending prefetch lock"`
+	pending   map[string]struct{} `label:"cache key of prefetch in progress"`
+	triggered uint64              `label:"prefetch triggered count"`
+	refreshed uint64              `label:"cache item refreshed by prefetch"`
+	failed    uint64              `label:"prefetch upstream query failed count"`
+	skipped   uint64              `label:"prefetch skipped by concurrency limit"`
+}
+
+// NewPrefetcher create cache prefetcher
+func NewPrefetcher(service *Service, percent int64, threshold int64, concurrency int) *Prefetcher {
+	return &Prefetcher{
+		Percent:   percent,
+		Threshold: threshold,
+		service:   service,
+		sem:       make(chan struct{}, concurrency),
+		mu:        new(sync.Mutex),
+		pending:   make(map[string]struct{}),
+	}
+}
+
+// Check start a background refresh if the cache item is popular and near to expire
+func (p *Prefetcher) Check(key string, req *dns.Msg) {
+	if p.Threshold < 0 {
+		return
+	}
+
+	var item, ok = p.service.cache.Peek(key)
+	if !ok || item.Expire <= item.Create || item.Hit < p.Threshold {
+		return
+	}
+
+	var now = time.Now().Unix()
+	if now > item.Expire || (now-item.Create)*100 < p.Percent*(item.Expire-item.Create) {
+		return
+	}
+
+	p.mu.Lock()
+	if _, ok = p.pending[key]; ok {
+		p.mu.Unlock()
+		return
+	}
+
+	select {
+	case p.sem <- struct{}{}:
+		p.pending[key] = struct{}{}
+		p.mu.Unlock()
+	default:
+		p.mu.Unlock()
+		atomic.AddUint64(&p.skipped, 1)
+		return
+	}
+
+	atomic.AddUint64(&p.triggered, 1)
+
+	go p.refresh(key, req.Question[0])
+}
+
+// Stats get prefetch statistics
+func (p *Prefetcher) Stats() *PrefetchStats {
+	return &PrefetchStats{
+		Triggered: atomic.LoadUint64(&p.triggered),
+		Refreshed: atomic.LoadUint64(&p.refreshed),
+		Failed:    atomic.LoadUint64(&p.failed),
+		Skipped:   atomic.LoadUint64(&p.skipped),
+		Saved:     p.service.cache.Stats().Prefetched,
+	}
+}
+
+// refresh query the forwarder group and update the cache item
+func (p *Prefetcher) refresh(key string, question dns.Question) {
+	defer func() {
+		p.mu.Lock()
+		delete(p.pending, key)
+		p.mu.Unlock()
+
+		<-p.sem
+	}()
+
+	var req = new(dns.Msg)
+	req.SetQuestion(question.Name, question.Qtype)
+	req.Question[0].Qclass = question.Qclass
+
+	var msg, err = p.service.exchange("prefetch", req)
+	if nil != err || !p.service.cache.Cacheable(msg.Msg) {
+		atomic.AddUint64(&p.failed, 1)
+		return
+	}
+
+	msg.Prefetch = true
+	p.service.chanItem <- msg
+
+	atomic.AddUint64(&p.refreshed, 1)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// newPrefetchService create dns query service of one forwarder, the prefetch is triggered at the second hit after half of the ttl
+func newPrefetchService(upstream *testUpstream, concurrency int) *Service {
+	var s = newTestService()
+	s.config.Rules = map[string]string{"default": "normal"}
+	s.config.Forwarders = map[string]*ForwarderGroup{"normal": {Servers: []string{upstream.addr}, Timeout: 200, AttemptTimeout: 200, Concurrency: 1}}
+	s.upstreams = map[string][]Upstream{"normal": {upstream}}
+	s.strategy = map[string]Strategy{"normal": &sequentialStrategy{}}
+	s.health.Add(upstream, time.Second)
+	s.cache.NegMinTTL = 60
+	s.prefetch = NewPrefetcher(s, 50, 2, concurrency)
+
+	return s
+}
+
+// setPrefetchItem add the cache item of the name, the elapsed second of the ttl is passed
+func setPrefetchItem(s *Service, name string, ttl int64, elapsed int64) string {
+	var now = time.Now().Unix()
+	var msg = newTestMsg(name, name+" 100 IN A 192.0.2.1")
+	var key = cacheKey(msg.Question[0])
+	s.cache.Set(key, &CacheItem{Msg: msg, Create: now - elapsed, Expire: now - elapsed + ttl})
+
+	return key
+}
+
+// queryPrefetch query the name from the cache for times
+func queryPrefetch(t *testing.T, s *Service, name string, times int) {
+	var req = new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	for i := 0; i < times; i++ {
+		if _, err := s.getFromCache(req); nil != err {
+			t.Fatalf("query %s from cache error: %v", name, err)
+		}
+	}
+}
+
+// waitPrefetch wait the prefetch statistics match the condition
+func waitPrefetch(t *testing.T, s *Service, cond func(stats *PrefetchStats) bool) {
+	var stats = s.prefetch.Stats()
+	for deadline := time.Now().Add(2 * time.Second); !cond(stats); stats = s.prefetch.Stats() {
+		if time.Now().After(deadline) {
+			t.Fatalf("wait prefetch timeout, stats %+v", stats)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPrefetchRefresh(t *testing.T) {
+	var s = newPrefetchService(&testUpstream{addr: "a"}, 2)
+
+	// the first hit is below the threshold, the second hit past 80% of the ttl trigger the refresh
+	var key = setPrefetchItem(s, "hot.example.com.", 100, 80)
+	queryPrefetch(t, s, "hot.example.com.", 1)
+	if stats := s.prefetch.Stats(); 0 != stats.Triggered {
+		t.Fatalf("cold item should not be prefetched, stats %+v", stats)
+	}
+	queryPrefetch(t, s, "hot.example.com.", 1)
+
+	var item *CacheItem
+	select {
+	case item = <-s.chanItem:
+	case <-time.After(2 * time.Second):
+		t.Fatal("hot item is not refreshed")
+	}
+	if !item.Prefetch || "hot.example.com." != item.Msg.Question[0].Name {
+		t.Errorf("refreshed item got %+v", item)
+	}
+	waitPrefetch(t, s, func(stats *PrefetchStats) bool { return 1 == stats.Refreshed })
+
+	// the refreshed item is fresh, the client hit of it is saved upstream query
+	s.cache.Set(key, item)
+	queryPrefetch(t, s, "hot.example.com.", 3)
+	if stats := s.prefetch.Stats(); 1 != stats.Triggered || 1 != stats.Saved || 0 != stats.Failed {
+		t.Errorf("hot item should be refreshed exactly once, stats %+v", stats)
+	}
+
+	// the item of few hit or the most of ttl left is not refreshed
+	setPrefetchItem(s, "cold.example.com.", 100, 80)
+	setPrefetchItem(s, "fresh.example.com.", 100, 10)
+	queryPrefetch(t, s, "cold.example.com.", 1)
+	queryPrefetch(t, s, "fresh.example.com.", 3)
+	if stats := s.prefetch.Stats(); 1 != stats.Triggered || 0 != len(s.chanItem) {
+		t.Errorf("cold and fresh item should not be prefetched, stats %+v", stats)
+	}
+}
+
+func TestPrefetchLimit(t *testing.T) {
+	var upstream = &testUpstream{addr: "a", block: 1}
+	var s = newPrefetchService(upstream, 1)
+
+	// the pending refresh is not triggered again
+	setPrefetchItem(s, "a.example.com.", 100, 80)
+	queryPrefetch(t, s, "a.example.com.", 4)
+	if stats := s.prefetch.Stats(); 1 != stats.Triggered || 0 != stats.Skipped {
+		t.Errorf("pending prefetch should not be triggered again, stats %+v", stats)
+	}
+
+	// the other item is skipped when the concurrency is full
+	setPrefetchItem(s, "b.example.com.", 100, 80)
+	queryPrefetch(t, s, "b.example.com.", 2)
+	if stats := s.prefetch.Stats(); 1 != stats.Triggered || 1 != stats.Skipped {
+		t.Errorf("prefetch over the concurrency should be skipped, stats %+v", stats)
+	}
+
+	// the timeout refresh is failed and release the concurrency
+	waitPrefetch(t, s, func(stats *PrefetchStats) bool { return 1 == stats.Failed && 0 == len(s.prefetch.sem) })
+	atomic.StoreInt32(&upstream.block, 0)
+	queryPrefetch(t, s, "b.example.com.", 1)
+	waitPrefetch(t, s, func(stats *PrefetchStats) bool { return 2 == stats.Triggered && 1 == stats.Refreshed })
+}
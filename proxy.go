@@ -132,7 +132,7 @@ func (p *Proxy) Run() error {
 	return nil
 }
 
-// reload reload config file and reset query cache
+// reload reload config file and keep query cache
 func (p *Proxy) reload() {
 	var err = p.service.Reload()
 	if nil != err {
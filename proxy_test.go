@@ -1,7 +1,9 @@
 package main
 
 import (
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 )
@@ -23,3 +25,35 @@ func BenchmarkDig(b *testing.B) {
 		c.Exchange(m, nameserver)
 	}
 }
+
+func BenchmarkCache(b *testing.B) {
+	var now = time.Now().Unix()
+	var keys = make([]string, 4096)
+	for i := range keys {
+		keys[i] = dns.Fqdn("host-" + strconv.Itoa(i) + "." + domain)
+	}
+
+	for _, shards := range []int{1, 32} {
+		b.Run("shards-"+strconv.Itoa(shards), func(b *testing.B) {
+			var cache = NewCache(0, 0, PolicyLRU, shards)
+			for _, k := range keys {
+				cache.Set(k, &CacheItem{Msg: newTestMsg(k, k+" 300 IN A 192.0.2.1"), Create: now, Expire: now + 300})
+			}
+
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				var i int
+				for pb.Next() {
+					var k = keys[i%len(keys)]
+					if 0 == i%16 {
+						cache.Set(k, &CacheItem{Msg: newTestMsg(k), Create: now, Expire: now + 300})
+					} else {
+						cache.Get(k)
+					}
+					i++
+				}
+			})
+		})
+	}
+}
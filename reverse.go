@@ -0,0 +1,182 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// privateReverse reverse zone of the private and special address, it is served locally as empty zone (RFC 6303)
+// the shared address space 100.64.0.0/10 is added by RFC 7793
+var privateReverse = func() map[string]bool {
+	var zones = []string{
+		"10.in-addr.arpa.",
+		"168.192.in-addr.arpa.",
+		"0.in-addr.arpa.",
+		"127.in-addr.arpa.",
+		"254.169.in-addr.arpa.",
+		"2.0.192.in-addr.arpa.",
+		"100.51.198.in-addr.arpa.",
+		"113.0.203.in-addr.arpa.",
+		"255.255.255.255.in-addr.arpa.",
+		"0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa.",
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa.",
+		"c.f.ip6.arpa.",
+		"d.f.ip6.arpa.",
+		"8.e.f.ip6.arpa.",
+		"9.e.f.ip6.arpa.",
+		"a.e.f.ip6.arpa.",
+		"b.e.f.ip6.arpa.",
+		"8.b.d.0.1.0.0.2.ip6.arpa.",
+	}
+
+	var ret = make(map[string]bool, len(zones)+80)
+	for _, zone := range zones {
+		ret[zone] = true
+	}
+	for i := 16; i < 32; i++ {
+		ret[strconv.Itoa(i)+".172.in-addr.arpa."] = true
+	}
+	for i := 64; i < 128; i++ {
+		ret[strconv.Itoa(i)+".100.in-addr.arpa."] = true
+	}
+
+	return ret
+}()
+
+// ReverseTable PTR record generated from the local address, the reverse name is in-addr.arpa for IPv4
+// and nibble format ip6.arpa for IPv6
+type ReverseTable struct {
+	records map[string][]dns.RR `label:"PTR record of the reverse name"`
+	names   map[string]bool     `label:"every reverse name and its parent"`
+}
+
+// NewReverseTable create empty reverse table
+func NewReverseTable() *ReverseTable {
+	return &ReverseTable{
+		records: make(map[string][]dns.RR),
+		names:   make(map[string]bool),
+	}
+}
+
+// Add add the PTR record of the ip to the host, the same host of the ip is added once
+func (r *ReverseTable) Add(ip net.IP, host string, ttl uint32) {
+	var name, err = dns.ReverseAddr(ip.String())
+	if nil != err {
+		return
+	}
+
+	host = dns.Fqdn(strings.ToLower(host))
+	for _, rr := range r.records[name] {
+		if host == rr.(*dns.PTR).Ptr {
+			return
+		}
+	}
+
+	r.records[name] = append(r.records[name], &dns.PTR{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl},
+		Ptr: host,
+	})
+	for off, end := 0, false; !end && !r.names[name[off:]]; off, end = dns.NextLabel(name, off) {
+		r.names[name[off:]] = true
+	}
+}
+
+// AddRecords add the PTR record of the A and AAAA record, the wildcard record is skipped
+func (r *ReverseTable) AddRecords(rrs []dns.RR) {
+	for _, rr := range rrs {
+		var hdr = rr.Header()
+		if strings.Contains(hdr.Name, "*") {
+			continue
+		}
+
+		switch v := rr.(type) {
+		case *dns.A:
+			r.Add(v.A, hdr.Name, hdr.Ttl)
+		case *dns.AAAA:
+			r.Add(v.AAAA, hdr.Name, hdr.Ttl)
+		}
+	}
+}
+
+// Length number of PTR record
+func (r *ReverseTable) Length() int {
+	var cnt int
+	for _, rrs := range r.records {
+		cnt += len(rrs)
+	}
+
+	return cnt
+}
+
+// Exist check the reverse name or its subdomain has PTR record
+func (r *ReverseTable) Exist(name string) bool {
+	return r.names[strings.ToLower(dns.Fqdn(name))]
+}
+
+// Answer answer the query of the reverse name, ErrNotFound is returned when the name is not in the table
+func (r *ReverseTable) Answer(req *dns.Msg) (*dns.Msg, error) {
+	var q = req.Question[0]
+	var rrs, ok = r.records[strings.ToLower(q.Name)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	var resp = new(dns.Msg)
+	resp.SetReply(req)
+	resp.Authoritative = true
+	if dns.TypePTR == q.Qtype || dns.TypeANY == q.Qtype {
+		for _, rr := range rrs {
+			resp.Answer = append(resp.Answer, mapperRecord(rr, q.Name))
+		}
+	}
+
+	return resp, nil
+}
+
+// privateReverseZone get the locally served reverse zone of the name
+func privateReverseZone(name string) (string, bool) {
+	name = strings.ToLower(dns.Fqdn(name))
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if privateReverse[name[off:]] {
+			return name[off:], true
+		}
+	}
+
+	return "", false
+}
+
+// privateReverseAnswer answer the query of the locally served empty zone (RFC 6303)
+// the apex has the SOA record only, the name under the apex is NXDOMAIN unless it exist as the parent of local PTR record
+func privateReverseAnswer(req *dns.Msg, zone string, exist bool) *dns.Msg {
+	var q = req.Question[0]
+	var soa = &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 10800},
+		Ns:      zone,
+		Mbox:    "nobody.invalid.",
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   1200,
+		Expire:  604800,
+		Minttl:  10800,
+	}
+
+	var resp = new(dns.Msg)
+	resp.SetReply(req)
+	resp.Authoritative = true
+	if zone != strings.ToLower(q.Name) {
+		if !exist {
+			resp.Rcode = dns.RcodeNameError
+		}
+		resp.Ns = []dns.RR{soa}
+	} else if dns.TypeSOA == q.Qtype || dns.TypeANY == q.Qtype {
+		soa.Hdr.Name = q.Name
+		resp.Answer = []dns.RR{soa}
+	} else {
+		resp.Ns = []dns.RR{soa}
+	}
+
+	return resp
+}
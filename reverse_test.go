@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestReverseTable(t *testing.T) {
+	var mapper, err = NewMapper([]string{
+		"www.imohe.com:192.168.1.1",
+		"mail.imohe.com:192.168.1.1",
+		"www.imohe.com:fd00::1",
+		".demo.imohe.com:8.8.8.8",
+		"*.wild.imohe.com. 60 IN A 192.168.1.3",
+	}, 60)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	var reverse = NewReverseTable()
+	reverse.Add(net.ParseIP("10.0.0.1"), "dns.proxy.server.", 60)
+	reverse.Add(net.ParseIP("10.0.0.1"), "DNS.proxy.server", 60)
+	reverse.AddRecords(mapper.Addresses())
+	if 5 != reverse.Length() {
+		t.Errorf("reverse table got %d record", reverse.Length())
+	}
+
+	var cases = []struct {
+		name  string
+		qtype uint16
+		want  []string
+	}{
+		{"1.0.0.10.in-addr.arpa.", dns.TypePTR, []string{"dns.proxy.server."}},
+		{"1.1.168.192.in-addr.arpa.", dns.TypePTR, []string{"mail.imohe.com.", "www.imohe.com."}},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", dns.TypePTR, []string{"www.imohe.com."}},
+		{"8.8.8.8.in-addr.arpa.", dns.TypePTR, []string{"demo.imohe.com."}},
+		{"1.1.168.192.in-addr.arpa.", dns.TypeA, nil},
+	}
+	for _, c := range cases {
+		var req = new(dns.Msg)
+		req.SetQuestion(c.name, c.qtype)
+
+		var resp, err = reverse.Answer(req)
+		if nil != err || len(resp.Answer) != len(c.want) {
+			t.Errorf("reverse %s got %v %v", c.name, resp, err)
+			continue
+		}
+		for i, rr := range resp.Answer {
+			if c.want[i] != rr.(*dns.PTR).Ptr {
+				t.Errorf("reverse %s answer %d got %s", c.name, i, rr)
+			}
+		}
+	}
+
+	var req = new(dns.Msg)
+	req.SetQuestion("3.1.168.192.in-addr.arpa.", dns.TypePTR)
+	if _, err = reverse.Answer(req); ErrNotFound != err {
+		t.Errorf("wildcard address should not have ptr, got %v", err)
+	}
+	if !reverse.Exist("1.168.192.in-addr.arpa.") || reverse.Exist("2.168.192.in-addr.arpa.") {
+		t.Error("reverse table parent name mismatch")
+	}
+}
+
+func TestPrivateReverse(t *testing.T) {
+	var zones = map[string]string{
+		"4.3.2.10.in-addr.arpa.":       "10.in-addr.arpa.",
+		"1.0.20.172.in-addr.arpa.":     "20.172.in-addr.arpa.",
+		"1.0.32.172.in-addr.arpa.":     "",
+		"1.0.64.100.in-addr.arpa.":     "64.100.in-addr.arpa.",
+		"168.192.in-addr.arpa.":        "168.192.in-addr.arpa.",
+		"8.8.8.8.in-addr.arpa.":        "",
+		"1.0.0.0.0.8.e.f.ip6.arpa.":    "8.e.f.ip6.arpa.",
+		"1.0.0.0.0.0.0.2.ip6.arpa.":    "",
+		"1.0.0.0.0.0.0.0.d.f.ip6.arpa": "d.f.ip6.arpa.",
+	}
+	for name, want := range zones {
+		if zone, _ := privateReverseZone(name); want != zone {
+			t.Errorf("private reverse zone of %s got %s", name, zone)
+		}
+	}
+
+	var s = newTestService()
+	s.reverse = NewReverseTable()
+	s.reverse.Add(net.ParseIP("192.168.1.1"), "www.imohe.com.", 60)
+
+	var cases = []struct {
+		name  string
+		qtype uint16
+		rcode int
+		local bool
+	}{
+		{"1.1.168.192.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess, true},
+		{"2.1.168.192.in-addr.arpa.", dns.TypePTR, dns.RcodeNameError, true},
+		{"1.168.192.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess, true},
+		{"168.192.in-addr.arpa.", dns.TypeSOA, dns.RcodeSuccess, true},
+		{"1.0.0.10.in-addr.arpa.", dns.TypePTR, dns.RcodeNameError, true},
+		{"8.8.8.8.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess, false},
+		{"1.0.16.172.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess, false},
+	}
+
+	// the private reverse zone of the forwarder rule is forwarded
+	s.rules.Add("16.172.in-addr.arpa", "normal")
+	for _, c := range cases {
+		var req = new(dns.Msg)
+		req.SetQuestion(c.name, c.qtype)
+
+		var resp, err = s.getFromReverse(req)
+		if !c.local {
+			if ErrNotFound != err {
+				t.Errorf("reverse %s should not be local, got %v", c.name, resp)
+			}
+			continue
+		}
+		if nil != err || c.rcode != resp.Rcode || !resp.Authoritative {
+			t.Errorf("reverse %s got %v %v", c.name, resp, err)
+			continue
+		}
+		if dns.RcodeNameError == resp.Rcode && (1 != len(resp.Ns) || dns.TypeSOA != resp.Ns[0].Header().Rrtype) {
+			t.Errorf("reverse %s NXDOMAIN should have SOA, got %v", c.name, resp.Ns)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// forwarder rule marker
+const (
+	ruleSuffix   = iota // example.com match the domain and all subdomain
+	ruleExact           // =example.com match the domain only
+	ruleWildcard        // *.example.com match the subdomain only
+)
+
+// rule file format
+const (
+	FormatGFWList = "gfwlist"
+	FormatDnsmasq = "dnsmasq"
+)
+
+// RuleFileOption forwarder rule source option, every domain of the file is forwarded to the group
+type RuleFileOption struct {
+	Path   string `json:"path" label:"rule file path"`
+	Format string `json:"format" label:"rule file format: domains, gfwlist, dnsmasq"`
+	Group  string `json:"group" label:"forwarder group of the domain"`
+}
+
+// Init check rule file option and fill default value
+func (r *RuleFileOption) Init() error {
+	if "" == r.Path {
+		return errors.New("proxy: rule file path is empty")
+	}
+	if "" == r.Group {
+		return errors.New("proxy: rule file " + r.Path + " miss forwarder group")
+	}
+
+	r.Format = strings.ToLower(r.Format)
+	switch r.Format {
+	case "":
+		r.Format = FormatDomains
+	case FormatDomains, FormatGFWList, FormatDnsmasq:
+	default:
+		return errors.New("proxy: rule file " + r.Path + " not support format " + r.Format)
+	}
+
+	return nil
+}
+
+// ruleNode trie node of one domain label
+type ruleNode struct {
+	children map[string]*ruleNode `label:"child node by the next label"`
+	suffix   string               `label:"group of the domain and all subdomain"`
+	exact    string               `label:"group of the domain only"`
+	wildcard string               `label:"group of the subdomain only"`
+}
+
+// RuleTrie forwarder rule trie keyed by the reversed domain label, the longest rule is matched
+type RuleTrie struct {
+	root  *ruleNode `label:"root node"`
+	count int       `label:"number of rule"`
+}
+
+// NewRuleTrie create empty rule trie
+func NewRuleTrie() *RuleTrie {
+	return &RuleTrie{
+		root: &ruleNode{},
+	}
+}
+
+// Add add forwarder rule, the later rule of the same domain and marker replace the former one
+func (t *RuleTrie) Add(rule string, group string) error {
+	var host = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(rule)), ".")
+	var kind = ruleSuffix
+
+	if strings.HasPrefix(host, "=") {
+		host, kind = host[1:], ruleExact
+	} else if strings.HasPrefix(host, "*.") {
+		host, kind = host[2:], ruleWildcard
+	} else {
+		host = strings.TrimPrefix(host, ".")
+	}
+	if _, ok := dns.IsDomainName(host); "" == host || !ok || strings.ContainsAny(host, "*=/: ") {
+		return errors.New("proxy: forwarder rule domain " + rule + " is invalid")
+	}
+
+	var node = t.root
+	for end := len(host); end > 0; {
+		var start = strings.LastIndexByte(host[:end], '.') + 1
+		var label = host[start:end]
+
+		var child, ok = node.children[label]
+		if !ok {
+			if nil == node.children {
+				node.children = make(map[string]*ruleNode)
+			}
+			child = &ruleNode{}
+			node.children[label] = child
+		}
+		node = child
+		end = start - 1
+	}
+
+	var marker = &node.suffix
+	if ruleExact == kind {
+		marker = &node.exact
+	} else if ruleWildcard == kind {
+		marker = &node.wildcard
+	}
+	if "" == *marker {
+		t.count++
+	}
+	*marker = group
+
+	return nil
+}
+
+// Load add every domain of the rule source to the group, the number of added rule is returned
+// domains is one rule per line, gfwlist is the base64 encoded autoproxy list, dnsmasq is the server=/domain/ip conf file
+func (t *RuleTrie) Load(option *RuleFileOption) (int, error) {
+	var data, err = os.ReadFile(option.Path)
+	if nil != err {
+		return 0, err
+	}
+
+	// gfwlist is distributed base64 encoded, the decoded list is also accepted
+	if FormatGFWList == option.Format {
+		var raw = bytes.Join(bytes.Fields(data), nil)
+		if decoded, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(raw))); nil == err {
+			data = decoded
+		}
+	}
+
+	var cnt int
+	var scanner = bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var domains []string
+		switch option.Format {
+		case FormatGFWList:
+			domains = parseGFWList(scanner.Text())
+		case FormatDnsmasq:
+			domains = parseDnsmasq(scanner.Text())
+		default:
+			domains = parseRuleDomain(scanner.Text())
+		}
+
+		for _, domain := range domains {
+			if nil == t.Add(domain, option.Group) {
+				cnt++
+			}
+		}
+	}
+	if err = scanner.Err(); nil != err {
+		return cnt, errors.New("proxy: read rule file " + option.Path + " failed, " + err.Error())
+	}
+
+	return cnt, nil
+}
+
+// Length number of rule
+func (t *RuleTrie) Length() int {
+	return t.count
+}
+
+// Match get the group of the longest rule match the host, host must be lower case without the trailing dot
+func (t *RuleTrie) Match(host string) (string, bool) {
+	var group string
+	var node = t.root
+
+	for end := len(host); end > 0; {
+		var start = strings.LastIndexByte(host[:end], '.') + 1
+		var child, ok = node.children[host[start:end]]
+		if !ok {
+			break
+		}
+		node = child
+
+		// the whole host is matched
+		if 0 == start {
+			if "" != node.exact {
+				return node.exact, true
+			}
+			if "" != node.suffix {
+				return node.suffix, true
+			}
+
+			break
+		}
+
+		if "" != node.wildcard {
+			group = node.wildcard
+		} else if "" != node.suffix {
+			group = node.suffix
+		}
+		end = start - 1
+	}
+
+	return group, "" != group
+}
+
+// parseRuleDomain parse one rule per line format, # is comment
+func parseRuleDomain(line string) []string {
+	if idx := strings.IndexByte(line, '#'); -1 != idx {
+		line = line[:idx]
+	}
+	if line = strings.TrimSpace(line); "" == line {
+		return nil
+	}
+
+	return []string{line}
+}
+
+// parseGFWList parse autoproxy rule of gfwlist: ||example.com, |http://example.com/path, .example.com and example.com
+// exception rule @@, regex rule and keyword with wildcard is ignored
+func parseGFWList(line string) []string {
+	line = strings.TrimSpace(line)
+	if "" == line || '!' == line[0] || '[' == line[0] || '/' == line[0] || strings.HasPrefix(line, "@@") {
+		return nil
+	}
+
+	line = strings.TrimLeft(line, "|")
+	if idx := strings.Index(line, "://"); -1 != idx {
+		line = line[idx+3:]
+	}
+	if idx := strings.IndexAny(line, "/:^"); -1 != idx {
+		line = line[:idx]
+	}
+	line = strings.TrimPrefix(line, ".")
+	if "" == line || strings.ContainsAny(line, "*%") || !strings.Contains(line, ".") {
+		return nil
+	}
+
+	return []string{line}
+}
+
+// parseDnsmasq parse dnsmasq conf line: server=/example.com/example.net/114.114.114.114, other option is ignored
+func parseDnsmasq(line string) []string {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "server=/") {
+		return nil
+	}
+
+	var parts = strings.Split(line[len("server=/"):], "/")
+	if len(parts) < 2 {
+		return nil
+	}
+
+	var domains []string
+	for _, domain := range parts[:len(parts)-1] {
+		if "" != domain {
+			domains = append(domains, domain)
+		}
+	}
+
+	return domains
+}
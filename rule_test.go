@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRuleTrieMatch(t *testing.T) {
+	var rules = NewRuleTrie()
+	for rule, group := range map[string]string{
+		"example.com":              "normal",
+		"k8s.internal.example.com": "k8s",
+		"corp.example.co.uk":       "office",
+		"=exact.example.com":       "exact",
+		"*.wild.example.com":       "wild",
+		".Upper.Example.NET.":      "upper",
+	} {
+		if err := rules.Add(rule, group); nil != err {
+			t.Fatal(err)
+		}
+	}
+	if 6 != rules.Length() {
+		t.Errorf("rule length got %d, want 6", rules.Length())
+	}
+
+	var cases = map[string]string{
+		"example.com":                  "normal",
+		"www.example.com":              "normal",
+		"k8s.internal.example.com":     "k8s",
+		"api.k8s.internal.example.com": "k8s",
+		"internal.example.com":         "normal",
+		"corp.example.co.uk":           "office",
+		"mail.corp.example.co.uk":      "office",
+		"example.co.uk":                "",
+		"exact.example.com":            "exact",
+		"www.exact.example.com":        "normal",
+		"wild.example.com":             "normal",
+		"a.b.wild.example.com":         "wild",
+		"www.upper.example.net":        "upper",
+		"example.org":                  "",
+		"com":                          "",
+	}
+	for host, want := range cases {
+		if group, _ := rules.Match(host); group != want {
+			t.Errorf("rule match %s got %q, want %q", host, group, want)
+		}
+	}
+
+	for _, rule := range []string{"", "*", "=", "exa mple.com", "http://example.com"} {
+		if err := rules.Add(rule, "normal"); nil == err {
+			t.Errorf("invalid rule %q should failed", rule)
+		}
+	}
+}
+
+func TestRuleTrieLoad(t *testing.T) {
+	var path = filepath.Join(t.TempDir(), "gfw.txt")
+	var data = "# proxy domain\ngoogle.com\n\n=youtube.com # exact\n*.twitter.com\nbad domain\n"
+	if err := os.WriteFile(path, []byte(data), 0644); nil != err {
+		t.Fatal(err)
+	}
+
+	var rules = NewRuleTrie()
+	var cnt, err = rules.Load(&RuleFileOption{Path: path, Group: "gfw"})
+	if nil != err || 3 != cnt {
+		t.Fatalf("load rule file got %d rule, error %v", cnt, err)
+	}
+	if group, _ := rules.Match("www.google.com"); "gfw" != group {
+		t.Errorf("rule file domain match got %q", group)
+	}
+	if _, ok := rules.Match("www.youtube.com"); ok {
+		t.Error("exact rule should not match subdomain")
+	}
+}
+
+func BenchmarkRuleTrieLoad(b *testing.B) {
+	var lines = make([]string, 50000)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("domain%d.example%d.com", i, i%100)
+	}
+	var path = filepath.Join(b.TempDir(), "rules.txt")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0644); nil != err {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := NewRuleTrie().Load(&RuleFileOption{Path: path, Group: "gfw"}); nil != err {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRuleTrieMatch(b *testing.B) {
+	var rules = NewRuleTrie()
+	for i := 0; i < 50000; i++ {
+		rules.Add(fmt.Sprintf("domain%d.example%d.com", i, i%100), "gfw")
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rules.Match("www.domain4999.example99.com")
+	}
+}
+
+func TestRuleTrieLoadFormat(t *testing.T) {
+	var dir = t.TempDir()
+	var gfwlist = "[AutoProxy 0.2.1]\n! comment\n||google.com\n|https://www.facebook.com/login\n.twitter.com\n@@||cn.example.com\n/^https?:\\/\\/[^\\/]+blogspot\\.(.*)/\nkeyword\n*.wild.com\nyoutube.com\n"
+	var encoded = base64.StdEncoding.EncodeToString([]byte(gfwlist))
+	var files = map[string]string{
+		"gfwlist.txt":  encoded[:40] + "\n" + encoded[40:],
+		"gfwlist.dec":  gfwlist,
+		"dnsmasq.conf": "# china list\nserver=/baidu.com/114.114.114.114\nserver=/qq.com/weixin.qq.com/223.5.5.5#53\nipset=/taobao.com/china\n",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); nil != err {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"gfwlist.txt", "gfwlist.dec"} {
+		var rules = NewRuleTrie()
+		var option = &RuleFileOption{Path: filepath.Join(dir, name), Format: "GFWList", Group: "gfw"}
+		option.Init()
+		if cnt, err := rules.Load(option); nil != err || 4 != cnt {
+			t.Errorf("load %s got %d rule, error %v", name, cnt, err)
+		}
+		for _, host := range []string{"www.google.com", "www.facebook.com", "api.twitter.com", "youtube.com"} {
+			if group, _ := rules.Match(host); "gfw" != group {
+				t.Errorf("%s rule %s got group %q", name, host, group)
+			}
+		}
+	}
+
+	var rules = NewRuleTrie()
+	var option = &RuleFileOption{Path: filepath.Join(dir, "dnsmasq.conf"), Format: "dnsmasq", Group: "normal"}
+	option.Init()
+	if cnt, err := rules.Load(option); nil != err || 3 != cnt {
+		t.Errorf("load dnsmasq got %d rule, error %v", cnt, err)
+	}
+	if group, _ := rules.Match("www.baidu.com"); "normal" != group {
+		t.Errorf("dnsmasq rule got group %q", group)
+	}
+	if _, ok := rules.Match("www.taobao.com"); ok {
+		t.Error("dnsmasq ipset option should be ignored")
+	}
+
+	if err := (&RuleFileOption{Path: "a", Group: "gfw", Format: "pac"}).Init(); nil == err {
+		t.Error("unknown rule file format should failed")
+	}
+}
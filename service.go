@@ -3,9 +3,8 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"net"
-	"strconv"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -15,22 +14,36 @@ import (
 
 // Service DNS query service
 type Service struct {
-	Logger     *Logger                      `label:"logger"`
-	client     *dns.Client                  `label:"DNS query client"`
-	config     *Config                      `label:"config manager"`
-	cache      *Cache                       `label:"dns query cache"`
-	ptr        []string                     `label:"dns name server ptr"`
-	chanExpire chan *dns.Msg                `label:"dns cache need update msg chan"`
-	chanItem   chan *CacheItem              `label:"dns query result item chain"`
-	mapper     map[string]map[string]net.IP `label:"subdomain mapper to ip list"`
+	Logger    *Logger               `label:"logger"`
+	config    *Config               `label:"config manager"`
+	cache     *Cache                `label:"dns query cache"`
+	filter    *Filter               `label:"dns query filter"`
+	reverse   *ReverseTable         `label:"PTR record of the local address"`
+	mu        *sync.RWMutex         `label:"PTR record lock, the record is rebuilt by the dynamic update"`
+	prefetch  *Prefetcher           `label:"dns cache prefetcher"`
+	flight    *Flight               `label:"identical in-flight upstream query coalesce"`
+	cert      *CertStore            `label:"tls certificate of encrypted dns listener"`
+	upstreams map[string][]Upstream `label:"forwarder transport of every group"`
+	health    *HealthChecker        `label:"forwarder health checker"`
+	strategy  map[string]Strategy   `label:"forwarder selection strategy of every group"`
+	rules     *RuleTrie             `label:"domain forwarder rule"`
+	chanItem  chan *CacheItem       `label:"dns query result item chain"`
+	mapper    *Mapper               `label:"subdomain mapper to local record"`
+	zones     *Zones                `label:"authoritative local zone"`
+	tsig      TSIGKeys              `label:"tsig key of zone transfer and dynamic update"`
 }
 
 // Init dns query service
 func (s *Service) Init(test bool) error {
 	var err error
 
-	s.chanExpire = make(chan *dns.Msg, 1024)
-	s.chanItem = make(chan *CacheItem, 1024)
+	// the cache writer goroutine is started once by Run, keep the chan when reload
+	if nil == s.chanItem {
+		s.chanItem = make(chan *CacheItem, 1024)
+	}
+	if nil == s.mu {
+		s.mu = new(sync.RWMutex)
+	}
 
 	// init dns proxy config
 	s.config, err = NewConfig(test)
@@ -38,17 +51,36 @@ func (s *Service) Init(test bool) error {
 		return err
 	}
 
-	// init dns client & cache
-	s.client = new(dns.Client)
-	s.client.Net = "udp"
-	s.client.UDPSize = dns.DefaultMsgSize * 2
-	s.client.Timeout = time.Millisecond * 600
-	s.cache = &Cache{
-		MinTTL:   600,
-		MaxTTL:   86400,
-		MaxCount: 0,
-		mu:       new(sync.RWMutex),
-		backend:  make(map[string]*CacheItem),
+	// init forwarder transport
+	s.health = NewHealthChecker(s.config.HealthFails, time.Duration(s.config.HealthBackoff)*time.Second, time.Duration(s.config.HealthMaxBackoff)*time.Second, s.config.HealthCanary)
+	s.upstreams = make(map[string][]Upstream, len(s.config.Forwarders))
+	s.strategy = make(map[string]Strategy, len(s.config.Forwarders))
+	for group, option := range s.config.Forwarders {
+		var timeout = time.Duration(option.Timeout) * time.Millisecond
+		for _, addr := range option.Servers {
+			var upstream Upstream
+			if upstream, err = NewUpstream(option.Address(addr), timeout); nil != err {
+				return err
+			}
+
+			s.upstreams[group] = append(s.upstreams[group], upstream)
+			s.health.Add(upstream, timeout)
+		}
+
+		var weights = upstreamWeights(option, s.upstreams[group], s.config.Weights)
+		if s.strategy[group], err = NewStrategy(option.Strategy, s.health, weights); nil != err {
+			return err
+		}
+	}
+
+	// init tls certificate, the listener keep the store so the certificate is hot reload
+	if nil == s.cert {
+		s.cert = NewCertStore()
+	}
+	if nil != s.config.TLS {
+		if err = s.cert.Load(s.config.TLS); nil != err {
+			return err
+		}
 	}
 
 	// init query log
@@ -57,80 +89,110 @@ func (s *Service) Init(test bool) error {
 		return err
 	}
 
-	// init dns ptr
-	var addrs []net.Addr
-	addrs, err = net.InterfaceAddrs()
-	if nil != err {
-		return err
-	}
-	if len(addrs) > 0 {
-		s.ptr = make([]string, len(addrs))
+	// init dns query filter
+	s.filter = NewFilter(s.config.Filters)
+	for i := range s.config.Blocklists {
+		var cnt int
+		var option = &s.config.Blocklists[i]
+		if cnt, err = s.filter.Load(option); nil != err {
+			return err
+		}
+
+		s.Logger.Write(LevelInfo, " [I] load %d domain of blocklist %s\n", cnt, option.Path)
 	}
-	for _, addr := range addrs {
-		var dot string
-		var sub []string
-		var tmp = strings.Split(addr.String(), "/")
-
-		if -1 == strings.Index(tmp[0], "::") {
-			if -1 == strings.Index(tmp[0], ".") {
-				dot = ":"
-				sub = strings.Split(tmp[0], ":")
-			} else {
-				dot = "."
-				sub = strings.Split(tmp[0], ".")
-			}
 
-			var val string
-			var cnt = len(sub)
-			var idx = cnt
-			for {
-				idx--
-				if idx < 0 {
-					break
-				}
+	// init forwarder rule, the rule source is reloaded with the config, the rule of config file replace the same rule of rule source
+	s.rules = NewRuleTrie()
+	for i := range s.config.RuleFiles {
+		var cnt int
+		var option = &s.config.RuleFiles[i]
+		if cnt, err = s.rules.Load(option); nil != err {
+			return err
+		}
 
-				val = val + sub[idx] + dot
-			}
+		s.Logger.Write(LevelInfo, " [I] load %d %s rule from %s to group %s\n", cnt, option.Format, option.Path, option.Group)
+	}
+	for domain, group := range s.config.Rules {
+		if "default" == domain {
+			continue
+		}
+		if err = s.rules.Add(domain, group); nil != err {
+			return err
+		}
+	}
 
-			s.ptr = append(s.ptr, val+"in-addr.arpa.")
+	// init authoritative local zone
+	if s.tsig, err = NewTSIGKeys(s.config.TSIG); nil != err {
+		return err
+	}
+	s.zones = nil
+	if len(s.config.Zones) > 0 {
+		if s.zones, err = NewZones(s.config.Zones); nil != err {
+			return err
+		}
+		for _, option := range s.config.Zones {
+			s.Logger.Write(LevelInfo, " [I] load %d record of zone %s from %s\n", s.zones.Get(option.Name).Length(), option.Name, option.File)
 		}
 	}
 
 	// init subdomain mapper
-	if nil != s.config.Mapper && len(s.config.Mapper) > 0 {
-		s.mapper = make(map[string]map[string]net.IP, len(s.config.Mapper))
-		for _, rule := range s.config.Mapper {
-			var val = strings.SplitN(rule, ":", 2)
-			if 2 != len(val) {
-				return errors.New("proxy: mapper rule format is domain:value, give " + rule)
-			}
-
-			var sub = strings.Split(val[0], ".")
-			var subLen = len(sub)
-			if subLen < 2 {
-				return errors.New("proxy: mapper domain miss root part, give " + val[0])
-			}
-
-			var key = sub[subLen-2] + "." + sub[subLen-1]
-			if _, ok := s.mapper[key]; !ok {
-				s.mapper[key] = make(map[string]net.IP)
-			}
-			s.mapper[key][val[0]] = net.ParseIP(val[1])
+	s.mapper = nil
+	if len(s.config.Mapper) > 0 {
+		if s.mapper, err = NewMapper(s.config.Mapper, uint32(s.config.MinTTL)); nil != err {
+			return err
 		}
 	}
 
+	// init dns ptr of the interface, mapper and local zone address
+	var reverse *ReverseTable
+	if reverse, err = s.newReverse(); nil != err {
+		return err
+	}
+	s.setReverse(reverse)
+
+	// init cache at last, the failed reload keep the old cache so it is not saved empty on shutdown
+	s.cache = NewCache(int64(s.config.Cache), s.config.CacheCount, s.config.CachePolicy, s.config.CacheShards)
+	s.cache.MinTTL = s.config.MinTTL
+	s.cache.MaxTTL = s.config.MaxTTL
+	s.cache.NegMinTTL = s.config.NegMinTTL
+	s.cache.NegMaxTTL = s.config.NegMaxTTL
+	s.cache.StaleTTL = s.config.StaleTTL
+	s.flight = NewFlight()
+	s.prefetch = NewPrefetcher(s, s.config.PrefetchPercent, s.config.PrefetchHits, s.config.PrefetchConcurrency)
+
 	return nil
 }
 
 // Shutdown dns service
 func (s *Service) Shutdown() {
-	close(s.chanExpire)
+	s.saveCache()
+
 	close(s.chanItem)
 }
 
-// Reload config file and reset query cache
+// Reload config file, the query cache is kept and limit by the new config
 func (s *Service) Reload() error {
-	return s.Init(false)
+	var cache = s.cache
+	var health = s.health
+	var upstreams = s.upstreams
+	if err := s.Init(false); nil != err {
+		return err
+	}
+
+	if nil != health {
+		health.Close()
+	}
+	for _, group := range upstreams {
+		for _, upstream := range group {
+			upstream.Close()
+		}
+	}
+
+	if nil != cache {
+		s.Logger.Write(LevelInfo, " [I] reload keep %d cache item\n", s.cache.Restore(cache))
+	}
+
+	return nil
 }
 
 // Reset query cache
@@ -138,38 +200,43 @@ func (s *Service) Reset() {
 	s.cache.Reset()
 }
 
+// Stats get dns service runtime statistics
+func (s *Service) Stats() map[string]interface{} {
+	return map[string]interface{}{
+		"cache":     s.cache.Stats(),
+		"prefetch":  s.prefetch.Stats(),
+		"flight":    s.flight.Stats(),
+		"upstreams": s.health.Stats(),
+	}
+}
+
 // Run dns cache service
 func (s *Service) Run() error {
 	var err error
-	var cKey string
-	var idx, num int
 
-	go func() {
-		for req := range s.chanExpire {
-			cKey = req.Question[0].String() + "|" + strconv.FormatUint(uint64(req.Question[0].Qtype), 10)
-			if s.cache.IsExpire(cKey) {
-				var group = s.getDomainForwarder(req.Question[0].Name)
-				var cnt = len(s.config.Forwarders[group])
-				var ctx, _ = context.WithTimeout(context.Background(), s.client.Timeout*5)
-
-				idx = (idx + 1) % cnt
-				var m, err = s.getDnsRecord(ctx, req, s.config.Forwarders[group][idx])
-				if nil == err {
-					if len(m.Msg.Answer) > 0 {
-						s.chanItem <- m
-					}
-				} else if nil != err {
-					s.Logger.Write(LevelError, " [E] client  query %s error: %s\n", s.toJSON(req.Question), err.Error())
-				}
-			}
+	if "" != s.config.CacheFile {
+		if cnt, err := s.cache.Load(s.config.CacheFile); nil == err {
+			s.Logger.Write(LevelInfo, " [I] load %d cache item from %s\n", cnt, s.config.CacheFile)
+		} else if !os.IsNotExist(err) {
+			s.Logger.Write(LevelError, " [E] load cache from %s error: %v\n", s.config.CacheFile, err)
 		}
-	}()
+	}
+
+	if "" != s.config.CacheFile && s.config.CacheSave > 0 {
+		go func() {
+			var ticker = time.NewTicker(time.Duration(s.config.CacheSave) * time.Second)
+			for range ticker.C {
+				s.saveCache()
+			}
+		}()
+	}
 
 	go func() {
+		var num int
+
 		for req := range s.chanItem {
 			num++
-			cKey = req.Msg.Question[0].String() + "|" + strconv.FormatUint(uint64(req.Msg.Question[0].Qtype), 10)
-			s.cache.Set(cKey, req)
+			s.cache.Set(cacheKey(req.Msg.Question[0]), req)
 
 			if num >= 100 {
 				num = 0
@@ -181,6 +248,19 @@ func (s *Service) Run() error {
 	return err
 }
 
+// saveCache write the query cache to snapshot file
+func (s *Service) saveCache() {
+	if nil == s.cache || nil == s.config || "" == s.config.CacheFile {
+		return
+	}
+
+	if cnt, err := s.cache.Save(s.config.CacheFile); nil == err {
+		s.Logger.Write(LevelInfo, " [I] save %d cache item to %s\n", cnt, s.config.CacheFile)
+	} else {
+		s.Logger.Write(LevelError, " [E] save cache to %s error: %v\n", s.config.CacheFile, err)
+	}
+}
+
 // Query dns request
 func (s *Service) Query(src string, req *dns.Msg) (*dns.Msg, error) {
 	defer func() {
@@ -189,12 +269,29 @@ func (s *Service) Query(src string, req *dns.Msg) (*dns.Msg, error) {
 		}
 	}()
 
-	var resp, err = s.getFromCache(req)
+	var resp, err = s.getFromFilter(req)
+	if nil == err {
+		if s.config.Logger.Access {
+			s.Logger.Write(LevelRaw, " [T] client %s query filter %s with result %s\n", src, s.toJSON(req.Question), dns.RcodeToString[resp.Rcode])
+		}
+
+		return resp, err
+	}
+
+	// the name of local zone is never forwarded
+	if resp, err = s.getFromZone(req); nil == err {
+		if s.config.Logger.Access {
+			s.Logger.Write(LevelRaw, " [T] client %s query zone %s with result %s\n", src, s.toJSON(req.Question), dns.RcodeToString[resp.Rcode])
+		}
+
+		return resp, err
+	}
+
+	resp, err = s.getFromCache(req)
 	if err == nil && s.config.Logger.Access {
 		s.Logger.Write(LevelRaw, " [T] client %s query cache %s with result %s\n", src, s.toJSON(req.Question), s.toJSON(resp.Answer))
 	} else if ErrCacheExpire == err {
-		err = nil
-		s.chanExpire <- req
+		resp, err = s.getFromStale(src, req, resp)
 	} else if ErrNotFound == err {
 		resp, err = s.getFromNet(src, req)
 	}
@@ -202,91 +299,308 @@ func (s *Service) Query(src string, req *dns.Msg) (*dns.Msg, error) {
 	return resp, err
 }
 
+// getFromNet query dns from forwarder group and update the cache
+// identical in-flight query share one upstream query, the waiter get a copy with its own message id
 func (s *Service) getFromNet(src string, req *dns.Msg) (*dns.Msg, error) {
+	var msg, shared, err = s.flight.Do(cacheKey(req.Question[0]), func() (*CacheItem, error) {
+		var msg, err = s.exchange(src, req)
+		if nil == err && s.cache.Cacheable(msg.Msg) {
+			s.chanItem <- msg
+		}
+
+		return msg, err
+	})
+	if nil != err {
+		return nil, err
+	}
+	if nil == msg {
+		return nil, ErrCacheTimeout
+	}
+
+	var resp = msg.Msg
+	if shared {
+		resp = resp.Copy()
+		resp.Id = req.Id
+		resp.Question = append([]dns.Question{}, req.Question...)
+	}
+
+	if s.config.Logger.Access {
+		s.Logger.Write(LevelRaw, " [T] client %s query remote %s with result %s\n", src, s.toJSON(req.Question), s.toJSON(resp.Answer))
+	}
+
+	return resp, nil
+}
+
+// exchange query the forwarder group of the domain, the group is retried when every forwarder failed or timeout
+func (s *Service) exchange(src string, req *dns.Msg) (*CacheItem, error) {
 	var err error
-	var flag bool
-	var msg *CacheItem
-	var resp *dns.Msg
-	var idx = s.config.Rand.Int()
-	var respChan = make(chan *CacheItem, s.config.Concurrency)
+	var msg, fallback *CacheItem
 	var group = s.getDomainForwarder(req.Question[0].Name)
-	var cnt = len(s.config.Forwarders[group])
-	var ctx, cancel = context.WithTimeout(context.Background(), s.client.Timeout)
+	var option = s.config.Forwarders[group]
 
-	defer func() {
-		close(respChan)
-		cancel()
-	}()
+	for i := 0; i <= option.Retries; i++ {
+		if msg, err = s.forward(src, req, group, option); nil == err {
+			return msg, nil
+		} else if nil != msg {
+			fallback = msg
+		}
+	}
 
-	for i := 0; i < s.config.Concurrency; i++ {
-		idx = (idx + i) % cnt
+	// the SERVFAIL or REFUSED answer is passed to the client when no forwarder answer
+	if nil != fallback {
+		return fallback, nil
+	}
+
+	return nil, err
+}
+
+// forward query the healthy forwarder of the group in the order of the group strategy, the first answer is used
+// the first forwarders of the fanout are queried at the same time, the next forwarder is queried when one failed
+// or not answered in the attempt timeout, the slow forwarder is still waited until the group timeout.
+// the SERVFAIL or REFUSED answer is a failure, the last one is returned with the error when every forwarder failed
+func (s *Service) forward(src string, req *dns.Msg, group string, option *ForwarderGroup) (*CacheItem, error) {
+	var strategy = s.strategy[group]
+	var upstreams = strategy.Select(s.health.Filter(s.upstreams[group]))
+	var cnt = len(upstreams)
+	var respChan = make(chan *CacheItem, cnt)
+	var failChan = make(chan *CacheItem, cnt)
+	var nextChan = make(chan struct{}, cnt)
+	var ctx, cancel = context.WithTimeout(context.Background(), time.Duration(option.Timeout)*time.Millisecond)
+
+	defer cancel()
+
+	// the chan is large enough for every forwarder, so the late answer never block
+	var query = func(upstream Upstream) {
+		var once sync.Once
+		var next = func() {
+			once.Do(func() { nextChan <- struct{}{} })
+		}
+		// the next forwarder is queried early only when the attempt timeout is less than the group timeout
+		if option.AttemptTimeout < option.Timeout {
+			var timer = time.AfterFunc(time.Duration(option.AttemptTimeout)*time.Millisecond, next)
+
+			defer timer.Stop()
+		}
+
+		var m, err = s.getDnsRecord(ctx, req, upstream, option)
+		if nil == err {
+			respChan <- m
+		} else if context.Canceled == ctx.Err() {
+			// other forwarder answer first, it is not the failure of this forwarder
+			return
+		} else {
+			s.Logger.Write(LevelError, " [E] client %s query %s from %s error: %s\n", src, s.toJSON(req.Question), upstream.Address(), err.Error())
+			next()
+			failChan <- m
+		}
+	}
+
+	var next int
+	for ; next < cnt && next < strategy.Fanout(option.Concurrency); next++ {
+		go query(upstreams[next])
+	}
 
-		go func(ctx context.Context, addr string) {
-			var m, err = s.getDnsRecord(ctx, req, addr)
-			if nil == err && !flag {
-				flag = true
-				respChan <- m
-			} else if nil != err {
-				s.Logger.Write(LevelError, " [E] client %s query %s error: %s\n", src, s.toJSON(req.Question), err.Error())
+	var fallback *CacheItem
+	for running := next; ; {
+		select {
+		case msg := <-respChan:
+			return msg, nil
+		case <-nextChan:
+			if next < cnt {
+				go query(upstreams[next])
+				next++
+				running++
 			}
-		}(ctx, s.config.Forwarders[group][idx])
+		case msg := <-failChan:
+			if nil != msg {
+				fallback = msg
+			}
+			if running--; 0 == running && next >= cnt {
+				return fallback, ErrForwarderFailed
+			}
+		case <-ctx.Done():
+			return fallback, ErrCacheTimeout
+		}
 	}
+}
 
-	select {
-	case msg = <-respChan:
-		err = nil
-		resp = msg.Msg
+// getFromStale refresh the expired cache from forwarder, the stale answer (RFC 8767) is served
+// only when the refresh is failed or exceed the client response deadline, the answer not cacheable like SERVFAIL and REFUSED is failed
+func (s *Service) getFromStale(src string, req *dns.Msg, stale *dns.Msg) (*dns.Msg, error) {
+	var respChan = make(chan *dns.Msg, 1)
+	var timer = time.NewTimer(time.Duration(s.config.StaleWait) * time.Millisecond)
 
-		s.chanItem <- msg
+	defer timer.Stop()
 
-		if s.config.Logger.Access {
-			s.Logger.Write(LevelRaw, " [T] client %s query remote %s with result %s\n", src, s.toJSON(req.Question), s.toJSON(resp.Answer))
+	go func() {
+		var resp, err = s.getFromNet(src, req)
+		if nil != err || !s.cache.Cacheable(resp) {
+			resp = nil
+		}
+
+		respChan <- resp
+	}()
+
+	select {
+	case resp := <-respChan:
+		if nil != resp {
+			return resp, nil
 		}
-	case <-ctx.Done():
-		err = ErrCacheTimeout
+	case <-timer.C:
 	}
 
-	return resp, err
+	if s.config.Logger.Access {
+		s.Logger.Write(LevelRaw, " [T] client %s query stale %s with result %s\n", src, s.toJSON(req.Question), s.toJSON(stale.Answer))
+	}
+
+	return staleAnswer(req, stale, uint32(s.config.StaleAnswer)), nil
 }
 
-// getDomainForwarder get domain mapper forwarder group name
+// getDomainForwarder get forwarder group name of the longest matched rule, default group is used when no rule match
 func (s *Service) getDomainForwarder(domain string) string {
-	var ret string
-	var host = strings.Trim(strings.TrimRight(strings.ToLower(domain), "dhcp\\ host."), ".")
-	var sub = strings.Split(host, ".")
-	var cnt = len(sub)
+	var host = strings.Trim(strings.TrimSuffix(strings.ToLower(domain), "dhcp\\ host."), ".")
+	if group, ok := s.rules.Match(host); ok {
+		return group
+	}
+
+	return s.config.Rules["default"]
+}
 
-	if cnt >= 2 {
-		var key = sub[cnt-2] + "." + sub[cnt-1]
-		ret = s.config.Rules[key]
+// getDnsRecord query the forwarder, the SERVFAIL or REFUSED answer is returned with ErrForwarderRcode
+// and counted as the failure of the forwarder, the same as the health probe. the cache time is limit by the ttl of the group
+func (s *Service) getDnsRecord(ctx context.Context, req *dns.Msg, upstream Upstream, option *ForwarderGroup) (*CacheItem, error) {
+	var resp, rtt, err = upstream.Exchange(ctx, req)
+	if nil == err && (dns.RcodeServerFailure == resp.Rcode || dns.RcodeRefused == resp.Rcode) {
+		err = ErrForwarderRcode
 	}
-	if "" == ret {
-		ret = s.config.Rules["default"]
+	if context.Canceled != ctx.Err() {
+		s.health.Record(upstream, rtt, err)
+	}
+	if nil != err && ErrForwarderRcode != err {
+		return nil, err
 	}
 
-	return ret
+	var now = time.Now().Unix()
+	var msg = &CacheItem{
+		Msg:    resp,
+		Create: now,
+		Expire: now + s.cache.LimitTTL(resp, option.MinTTL, option.MaxTTL),
+	}
+
+	return msg, err
 }
 
-func (s *Service) getDnsRecord(ctx context.Context, req *dns.Msg, addr string) (*CacheItem, error) {
-	var resp, rtt, err = s.client.ExchangeContext(ctx, req, addr)
-	if nil == err {
-		var ttl = int64(rtt.Seconds())
-		if ttl < s.cache.MinTTL {
-			ttl = s.cache.MinTTL
-		}
-		if ttl > s.cache.MaxTTL {
-			ttl = s.cache.MaxTTL
-		}
+// getFromFilter check query by filter rule, ErrNotFound is not filtered
+func (s *Service) getFromFilter(req *dns.Msg) (*dns.Msg, error) {
+	if s.filter.Empty() {
+		return nil, ErrNotFound
+	}
+
+	if action := s.filter.Match(req.Question[0].Name, req.Question[0].Qtype); "" != action {
+		return filterAnswer(req, action, uint32(s.cache.MinTTL)), nil
+	}
+
+	return nil, ErrNotFound
+}
+
+// Transfer get the record of the zone transfer request, the rcode is not success when the zone is not exist or the client is refused
+// status is the TSIG verify result of the request
+func (s *Service) Transfer(src string, req *dns.Msg, status error) ([]dns.RR, int) {
+	var zone *Zone
+	if nil != s.zones {
+		zone = s.zones.Get(req.Question[0].Name)
+	}
+	if nil == zone {
+		s.Logger.Write(LevelError, " [E] client %s transfer zone %s is not exist\n", src, req.Question[0].Name)
+
+		return nil, dns.RcodeNotAuth
+	}
+	if nil != req.IsTsig() && nil != status {
+		s.Logger.Write(LevelError, " [E] client %s transfer zone %s tsig error: %v\n", src, zone.Origin, status)
+
+		return nil, dns.RcodeNotAuth
+	}
+
+	var host, _, _ = net.SplitHostPort(src)
+	if !zone.Allow(net.ParseIP(host), tsigKey(req, status)) {
+		s.Logger.Write(LevelError, " [E] client %s transfer zone %s is refused\n", src, zone.Origin)
+
+		return nil, dns.RcodeRefused
+	}
+
+	var rrs = zone.Transfer(req)
+	s.Logger.Write(LevelInfo, " [I] client %s %s zone %s with %d record\n", src, dns.TypeToString[req.Question[0].Qtype], zone.Origin, len(rrs))
+
+	return rrs, dns.RcodeSuccess
+}
+
+// Update apply the dynamic update request to the local zone, the request must be signed by the update key of the zone
+// status is the TSIG verify result of the request
+func (s *Service) Update(src string, req *dns.Msg, status error) int {
+	if 1 != len(req.Question) || dns.TypeSOA != req.Question[0].Qtype {
+		return dns.RcodeFormatError
+	}
+
+	var zone *Zone
+	if nil != s.zones {
+		zone = s.zones.Get(req.Question[0].Name)
+	}
+	if nil == zone {
+		s.Logger.Write(LevelError, " [E] client %s update zone %s is not exist\n", src, req.Question[0].Name)
+
+		return dns.RcodeNotAuth
+	}
+	if nil != req.IsTsig() && nil != status {
+		s.Logger.Write(LevelError, " [E] client %s update zone %s tsig error: %v\n", src, zone.Origin, status)
 
-		var msg = &CacheItem{
-			Msg:    resp,
-			Expire: time.Now().Unix() + ttl,
+		return dns.RcodeNotAuth
+	}
+
+	var host, _, _ = net.SplitHostPort(src)
+	if !zone.AllowUpdate(net.ParseIP(host), tsigKey(req, status)) {
+		s.Logger.Write(LevelError, " [E] client %s update zone %s is refused\n", src, zone.Origin)
+
+		return dns.RcodeRefused
+	}
+
+	var rcode, err = zone.Update(req)
+	if nil != err {
+		s.Logger.Write(LevelError, " [E] client %s update zone %s write journal error: %v\n", src, zone.Origin, err)
+	} else {
+		s.Logger.Write(LevelInfo, " [I] client %s update zone %s with result %s\n", src, zone.Origin, dns.RcodeToString[rcode])
+	}
+
+	// the PTR record follow the updated address, the rebuild is serialized so the table of the last update is kept
+	if dns.RcodeSuccess == rcode {
+		s.mu.Lock()
+		if reverse, err := s.newReverse(); nil == err {
+			s.reverse = reverse
 		}
+		s.mu.Unlock()
+	}
+
+	return rcode
+}
+
+// getFromZone answer query by the closest authoritative local zone, ErrNotFound is not in any zone
+// zone transfer and dynamic update are only served by the name server, the request of other listener is refused rather than forwarded
+func (s *Service) getFromZone(req *dns.Msg) (*dns.Msg, error) {
+	if dns.OpcodeQuery != req.Opcode {
+		return new(dns.Msg).SetRcode(req, dns.RcodeNotImplemented), nil
+	}
+	if dns.TypeAXFR == req.Question[0].Qtype || dns.TypeIXFR == req.Question[0].Qtype {
+		return new(dns.Msg).SetRcode(req, dns.RcodeRefused), nil
+	}
+	if nil == s.zones || dns.ClassINET != req.Question[0].Qclass {
+		return nil, ErrNotFound
+	}
 
-		return msg, nil
+	var zone = s.zones.Find(req.Question[0].Name)
+	if nil == zone {
+		return nil, ErrNotFound
 	}
 
-	return nil, err
+	return zone.Answer(req), nil
 }
 
 // getFromCache query dns from cache
@@ -294,115 +608,112 @@ func (s *Service) getFromCache(req *dns.Msg) (*dns.Msg, error) {
 	var err error
 	var resp *dns.Msg
 
-	// check query ptr
-	if nil != s.ptr && dns.TypePTR == req.Question[0].Qtype && dns.ClassINET == req.Question[0].Qclass {
-		resp, err = s.getDnsPtr((req))
+	// check query host is mapper
+	if nil != s.mapper && dns.ClassINET == req.Question[0].Qclass {
+		resp, err = s.mapper.Answer(req)
 	}
 
-	// check query host is mapper
-	if nil != s.mapper && (dns.TypeA == req.Question[0].Qtype || dns.TypeAAAA == req.Question[0].Qtype) && dns.ClassINET == req.Question[0].Qclass {
-		resp, err = s.getDnsMapper((req))
+	// check query ptr
+	if nil == resp && nil != s.getReverse() && dns.ClassINET == req.Question[0].Qclass {
+		resp, err = s.getFromReverse(req)
 	}
 
 	if nil == resp || ErrNotFound == err {
-		var cKey = req.Question[0].String() + "|" + strconv.FormatUint(uint64(req.Question[0].Qtype), 10)
+		var cKey = cacheKey(req.Question[0])
 		resp, err = s.cache.Get(cKey)
 		if nil != resp {
 			resp.Id = req.Id
 		}
+		if nil == err {
+			s.prefetch.Check(cKey, req)
+		}
 	}
 
 	return resp, err
 }
 
-func (s *Service) getDnsPtr(req *dns.Msg) (*dns.Msg, error) {
-	for _, v := range s.ptr {
-		if v == req.Question[0].Name {
-			var resp = &dns.Msg{
-				Question: req.Question,
-				Answer: []dns.RR{
-					&dns.PTR{
-						Hdr: dns.RR_Header{
-							Name:     req.Question[0].Name,
-							Rrtype:   req.Question[0].Qtype,
-							Class:    req.Question[0].Qclass,
-							Ttl:      uint32(s.cache.MinTTL),
-							Rdlength: uint16(strings.Count(s.config.Name, "")),
-						},
-						Ptr: s.config.Name,
-					},
-				},
-			}
+// getFromReverse answer the reverse query of the local address, ErrNotFound is not local
+// the private reverse name not local is NXDOMAIN rather than forwarded (RFC 6303), unless the forwarder rule match the name
+func (s *Service) getFromReverse(req *dns.Msg) (*dns.Msg, error) {
+	var reverse = s.getReverse()
+	var resp, err = reverse.Answer(req)
+	if ErrNotFound != err {
+		return resp, err
+	}
 
-			resp.Rcode = dns.RcodeSuccess
-			resp.Id = req.Id
+	var zone, ok = privateReverseZone(req.Question[0].Name)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if _, ok = s.rules.Match(strings.Trim(strings.ToLower(req.Question[0].Name), ".")); ok {
+		return nil, ErrNotFound
+	}
 
-			return resp, nil
+	return privateReverseAnswer(req, zone, reverse.Exist(req.Question[0].Name)), nil
+}
+
+// getReverse get the current PTR record table
+func (s *Service) getReverse() *ReverseTable {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.reverse
+}
+
+// setReverse replace the PTR record table
+func (s *Service) setReverse(reverse *ReverseTable) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reverse = reverse
+}
+
+// newReverse create the PTR record of the interface address to the server name, and the A and AAAA record of the mapper and local zone
+func (s *Service) newReverse() (*ReverseTable, error) {
+	var addrs, err = net.InterfaceAddrs()
+	if nil != err {
+		return nil, err
+	}
+
+	var reverse = NewReverseTable()
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			reverse.Add(ipnet.IP, s.config.Name, uint32(s.config.MinTTL))
+		}
+	}
+	if nil != s.mapper {
+		reverse.AddRecords(s.mapper.Addresses())
+	}
+	if nil != s.zones {
+		for _, zone := range s.zones.zones {
+			reverse.AddRecords(zone.Addresses())
 		}
 	}
 
-	return nil, ErrNotFound
+	return reverse, nil
 }
 
-func (s *Service) getDnsMapper(req *dns.Msg) (*dns.Msg, error) {
-	var resp *dns.Msg
-	var domain = strings.Trim(strings.TrimRight(strings.ToLower(req.Question[0].Name), "dhcp\\ host."), ".")
-	var sub = strings.Split(domain, ".")
-	var cnt = len(sub)
-	var key = sub[cnt-2] + "." + sub[cnt-1]
-
-	if items, ok := s.mapper[key]; ok {
-		var idx int
-		var flag bool
-		var host net.IP
-		var tmp string
-
-		for {
-			tmp = strings.Join(sub[idx:cnt], ".")
-
-			if host, ok = items[tmp]; ok {
-				flag = true
-			} else if host, ok = items["."+tmp]; ok {
-				flag = true
-			}
-
-			if flag {
-				if dns.TypeA == req.Question[0].Qtype {
-					resp = &dns.Msg{
-						Question: req.Question,
-						Answer: []dns.RR{
-							&dns.A{
-								Hdr: dns.RR_Header{
-									Name:     domain + ".",
-									Rrtype:   dns.TypeA,
-									Class:    req.Question[0].Qclass,
-									Ttl:      uint32(s.cache.MinTTL),
-									Rdlength: 0x4,
-								},
-								A: host,
-							},
-						},
-					}
-				} else {
-					resp = &dns.Msg{
-						Question: req.Question,
-						Answer:   []dns.RR{},
-					}
-				}
-
-				resp.Id = req.Id
-
-				return resp, nil
+// staleAnswer set the stale answer record ttl and add Extended DNS Error "Stale Answer" (RFC 8914)
+func staleAnswer(req *dns.Msg, resp *dns.Msg, ttl uint32) *dns.Msg {
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			if dns.TypeOPT != rr.Header().Rrtype {
+				rr.Header().Ttl = ttl
 			}
+		}
+	}
 
-			idx++
-			if flag || idx+1 == cnt {
-				break
-			}
+	if opt := req.IsEdns0(); nil != opt {
+		var ret = resp.IsEdns0()
+		if nil == ret {
+			resp.SetEdns0(opt.UDPSize(), opt.Do())
+			ret = resp.IsEdns0()
 		}
+
+		ret.Option = append(ret.Option, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeStaleAnswer})
 	}
 
-	return nil, ErrNotFound
+	return resp
 }
 
 // toJSON convert values to json byte
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// newTestService create dns query service without forwarder, the answer is from the cache
+func newTestService(rr ...string) *Service {
+	var now = time.Now().Unix()
+	var s = &Service{
+		config:   &Config{Logger: &LoggerOption{}},
+		cache:    NewCache(0, 0, PolicyLRU, 1),
+		filter:   &Filter{},
+		rules:    NewRuleTrie(),
+		mu:       new(sync.RWMutex),
+		flight:   NewFlight(),
+		health:   NewHealthChecker(3, time.Second, time.Minute, "."),
+		chanItem: make(chan *CacheItem, 16),
+		Logger:   &Logger{level: LevelError, backend: os.Stderr},
+	}
+	s.prefetch = NewPrefetcher(s, 90, -1, 1)
+
+	for _, v := range rr {
+		var msg = newTestMsg("", v)
+		msg.Question[0].Name = msg.Answer[0].Header().Name
+		msg.Question[0].Qtype = msg.Answer[0].Header().Rrtype
+
+		s.cache.Set(cacheKey(msg.Question[0]), &CacheItem{Msg: msg, Create: now, Expire: now + int64(msg.Answer[0].Header().Ttl)})
+	}
+
+	return s
+}
+
+func TestStaleAnswer(t *testing.T) {
+	var req = new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	req.SetEdns0(1232, false)
+
+	var resp = staleAnswer(req, newTestMsg("a.example.com.", "a.example.com. 0 IN A 192.0.2.1"), 30)
+	if 30 != resp.Answer[0].Header().Ttl {
+		t.Errorf("stale answer ttl got %d, want 30", resp.Answer[0].Header().Ttl)
+	}
+
+	var opt = resp.IsEdns0()
+	if nil == opt || 1 != len(opt.Option) {
+		t.Fatalf("stale answer miss extended dns error: %v", resp)
+	}
+	if ede, ok := opt.Option[0].(*dns.EDNS0_EDE); !ok || dns.ExtendedErrorCodeStaleAnswer != ede.InfoCode {
+		t.Errorf("stale answer extended dns error got %v", opt.Option[0])
+	}
+}
+
+func TestReloadFailedKeepCache(t *testing.T) {
+	var dir = t.TempDir()
+	var path = filepath.Join(dir, "proxy.json")
+	var data = `{"cache_file": "` + filepath.Join(dir, "cache.json") + `", "forwarders": {"normal": ["127.0.0.1:53"]}, "rules": {"default": "normal"},
+		"rule_files": [{"path": "` + filepath.Join(dir, "missing.txt") + `", "group": "normal"}]}`
+	if err := os.WriteFile(path, []byte(data), 0644); nil != err {
+		t.Fatal(err)
+	}
+
+	var file = *configFile
+	*configFile = path
+	defer func() { *configFile = file }()
+
+	var s = newTestService("www.example.com. 300 IN A 192.0.2.1")
+	var cache = s.cache
+	if err := s.Reload(); nil == err {
+		t.Fatal("reload with missing rule file should failed")
+	}
+	if cache != s.cache || 1 != s.cache.Length() {
+		t.Errorf("failed reload should keep the old cache, got %d item", s.cache.Length())
+	}
+}
+
+func TestStaleRefreshFailed(t *testing.T) {
+	var a, b = &testUpstream{addr: "a"}, &testUpstream{addr: "b"}
+	var s = newTestService()
+	s.config.StaleWait = 1000
+	s.config.StaleAnswer = 30
+	s.config.Rules = map[string]string{"default": "normal"}
+	s.config.Forwarders = map[string]*ForwarderGroup{"normal": {Servers: []string{"a", "b"}, Timeout: 500, AttemptTimeout: 500, Concurrency: 2}}
+	s.upstreams = map[string][]Upstream{"normal": {a, b}}
+	s.strategy = map[string]Strategy{"normal": &sequentialStrategy{}}
+
+	var req = new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	req.SetEdns0(1232, false)
+	var stale = newTestMsg("a.example.com.", "a.example.com. 0 IN A 192.0.2.1")
+
+	// every forwarder failed by error or the answer not cacheable, the stale answer is served
+	var cases = []struct {
+		down  int32
+		rcode int32
+	}{
+		{1, dns.RcodeSuccess},
+		{0, dns.RcodeServerFailure},
+		{0, dns.RcodeRefused},
+		{0, dns.RcodeNotImplemented},
+	}
+	for _, c := range cases {
+		for _, upstream := range []*testUpstream{a, b} {
+			atomic.StoreInt32(&upstream.down, c.down)
+			atomic.StoreInt32(&upstream.rcode, c.rcode)
+		}
+
+		var resp, err = s.getFromStale("test", req, stale)
+		if nil != err || 1 != len(resp.Answer) || nil == resp.IsEdns0() {
+			t.Errorf("refresh failed by %s down %d should serve stale answer, got %v %v", dns.RcodeToString[int(c.rcode)], c.down, resp, err)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// snapshotMagic dns cache snapshot file header
+var snapshotMagic = []byte("DNSPROXY-CACHE\x00\x01")
+
+// ErrSnapshotFormat dns cache snapshot file is broken
+var ErrSnapshotFormat = errors.New("cache snapshot format is invalid")
+
+// Save write cache item to snapshot file, every item is saved as
+// create time, expire time, hit count, message length and wire format message
+// the file is replaced atomically so a crash never leave a broken snapshot
+func (c *Cache) Save(path string) (int, error) {
+	var cnt int
+	var buf []byte
+	var head [28]byte
+
+	c.store.Range(func(item *CacheItem) {
+		var msg, err = item.Msg.Pack()
+		if nil != err {
+			return
+		}
+
+		binary.BigEndian.PutUint64(head[0:], uint64(item.Create))
+		binary.BigEndian.PutUint64(head[8:], uint64(item.Expire))
+		binary.BigEndian.PutUint64(head[16:], uint64(item.Hit))
+		binary.BigEndian.PutUint32(head[24:], uint32(len(msg)))
+
+		buf = append(buf, head[:]...)
+		buf = append(buf, msg...)
+		cnt++
+	})
+
+	var fp, err = os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if nil != err {
+		return 0, err
+	}
+	defer os.Remove(fp.Name())
+
+	if _, err = fp.Write(snapshotMagic); nil == err {
+		_, err = fp.Write(buf)
+	}
+	if nil == err {
+		err = fp.Sync()
+	}
+	if closeErr := fp.Close(); nil == err {
+		err = closeErr
+	}
+	if nil == err {
+		err = os.Rename(fp.Name(), path)
+	}
+	if nil != err {
+		return 0, err
+	}
+
+	return cnt, nil
+}
+
+// Load warm the cache from snapshot file
+// item out of the stale window is dropped, so expired item is kept only when serve stale is enable
+func (c *Cache) Load(path string) (int, error) {
+	var cnt int
+	var head [28]byte
+	var magic = make([]byte, len(snapshotMagic))
+
+	var fp, err = os.Open(path)
+	if nil != err {
+		return 0, err
+	}
+	defer fp.Close()
+
+	var reader = bufio.NewReader(fp)
+	if _, err = io.ReadFull(reader, magic); nil != err || string(magic) != string(snapshotMagic) {
+		return 0, ErrSnapshotFormat
+	}
+
+	var now = time.Now().Unix()
+	for {
+		if _, err = io.ReadFull(reader, head[:]); io.EOF == err {
+			break
+		} else if nil != err {
+			return cnt, ErrSnapshotFormat
+		}
+
+		var buf = make([]byte, binary.BigEndian.Uint32(head[24:]))
+		if _, err = io.ReadFull(reader, buf); nil != err {
+			return cnt, ErrSnapshotFormat
+		}
+
+		var item = &CacheItem{
+			Msg:    new(dns.Msg),
+			Create: int64(binary.BigEndian.Uint64(head[0:])),
+			Expire: int64(binary.BigEndian.Uint64(head[8:])),
+			Hit:    int64(binary.BigEndian.Uint64(head[16:])),
+		}
+		if item.Expire > 0 && item.Expire < now && (c.StaleTTL < 0 || now-item.Expire > c.StaleTTL) {
+			continue
+		}
+		if err = item.Msg.Unpack(buf); nil != err || 0 == len(item.Msg.Question) {
+			continue
+		}
+
+		c.Set(cacheKey(item.Msg.Question[0]), item)
+		cnt++
+	}
+
+	return cnt, nil
+}
+
+// Restore copy the cache item of other cache, it keep the cache when config reload
+func (c *Cache) Restore(from *Cache) int {
+	var items []*CacheItem
+
+	from.store.Range(func(item *CacheItem) {
+		items = append(items, &CacheItem{
+			Hit:    item.Hit,
+			Create: item.Create,
+			Expire: item.Expire,
+			Msg:    item.Msg,
+		})
+	})
+
+	for _, item := range items {
+		c.Set(cacheKey(item.Msg.Question[0]), item)
+	}
+
+	return len(items)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestCacheSnapshot(t *testing.T) {
+	var now = time.Now().Unix()
+	var path = filepath.Join(t.TempDir(), "cache.dat")
+	var cache = NewCache(0, 0, PolicyLRU, 1)
+	cache.StaleTTL = 60
+
+	var items = map[string]*CacheItem{
+		"fresh": {Msg: newTestMsg("a.example.com.", "a.example.com. 300 IN A 192.0.2.1"), Create: now - 100, Expire: now + 200, Hit: 5},
+		"stale": {Msg: newTestMsg("b.example.com.", "b.example.com. 300 IN A 192.0.2.2"), Create: now - 330, Expire: now - 30},
+		"drop":  {Msg: newTestMsg("c.example.com.", "c.example.com. 300 IN A 192.0.2.3"), Create: now - 500, Expire: now - 200},
+	}
+	for _, item := range items {
+		cache.Set(cacheKey(item.Msg.Question[0]), item)
+	}
+
+	if cnt, err := cache.Save(path); nil != err || 3 != cnt {
+		t.Fatalf("save cache snapshot got %d %v, want 3", cnt, err)
+	}
+
+	var restore = NewCache(0, 0, PolicyLRU, 1)
+	restore.StaleTTL = 60
+	if cnt, err := restore.Load(path); nil != err || 2 != cnt {
+		t.Fatalf("load cache snapshot got %d %v, want 2", cnt, err)
+	}
+
+	var item, ok = restore.Peek(cacheKey(items["fresh"].Msg.Question[0]))
+	if !ok || 5 != item.Hit || items["fresh"].Expire != item.Expire {
+		t.Errorf("restore cache item got %+v, want %+v", item, items["fresh"])
+	}
+	if msg, err := restore.Get(cacheKey(items["stale"].Msg.Question[0])); ErrCacheExpire != err || "192.0.2.2" != msg.Answer[0].(*dns.A).A.String() {
+		t.Errorf("restore stale cache item got %v %v", msg, err)
+	}
+
+	if err := os.WriteFile(path, []byte("broken"), 0644); nil != err {
+		t.Fatal(err)
+	}
+	if _, err := restore.Load(path); ErrSnapshotFormat != err {
+		t.Errorf("load broken cache snapshot got %v, want %v", err, ErrSnapshotFormat)
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// cacheItemOverhead approximate memory of cache item struct, map and list entry
+const cacheItemOverhead = 256
+
+// lfuSample number of least recently used item to compare hit count in lfu policy
+const lfuSample = 8
+
+// CacheStore dns query cache storage
+type CacheStore interface {
+	// Get get item and mark it recently used, the returned item must not be modified
+	Get(key string) (CacheItem, bool)
+	// Peek get item without update the recently used list
+	Peek(key string) (CacheItem, bool)
+	// Set add or replace item, evict other item when the store is full
+	Set(key string, item *CacheItem)
+	// Remove delete item
+	Remove(key string)
+	// Length number of item
+	Length() int
+	// Reset delete all item
+	Reset()
+	// Sweep check at most limit item and remove the item expire before the time
+	Sweep(expire int64, limit int) int
+	// Range call fn with every item from the least recently used, the item must not be modified
+	Range(fn func(item *CacheItem))
+	// Stats get store statistics
+	Stats() *CacheStats
+}
+
+// LRUStore single lock cache store with size and count limit
+type LRUStore struct {
+	maxSize    int64                 `label:"approximate memory bytes limit, zero is not limit"`
+	maxCount   int                   `label:"number of item limit, zero is not limit"`
+	policy     string                `label:"eviction policy: lru, lfu"`
+	size       int64                 `label:"approximate memory bytes of item"`
+	evicts     uint64                `label:"item evicted by size or count limit"`
+	expires    uint64                `label:"expired item removed by sweep"`
+	prefetched uint64                `label:"prefetched item hit by client"`
+	mu         *sync.RWMutex         `label:"store read & write lock"`
+	lru        *list.List            `label:"recently used list, front is the most recently used"`
+	cursor     *list.Element         `label:"position of the incremental expire sweep"`
+	backend    map[string]*CacheItem `label:"cache item store"`
+}
+
+// NewLRUStore create single lock cache store
+func NewLRUStore(maxSize int64, maxCount int, policy string) *LRUStore {
+	return &LRUStore{
+		maxSize:  maxSize,
+		maxCount: maxCount,
+		policy:   policy,
+		mu:       new(sync.RWMutex),
+		lru:      list.New(),
+		backend:  make(map[string]*CacheItem),
+	}
+}
+
+// Get get item and mark it recently used
+func (s *LRUStore) Get(key string) (CacheItem, bool) {
+	var ret CacheItem
+
+	s.mu.Lock()
+	item, ok := s.backend[key]
+	if ok {
+		item.Hit++
+		s.lru.MoveToFront(item.elem)
+
+		if item.Prefetch {
+			item.Prefetch = false
+			s.prefetched++
+		}
+
+		ret = *item
+	}
+	s.mu.Unlock()
+
+	return ret, ok
+}
+
+// Peek get item without update the recently used list
+func (s *LRUStore) Peek(key string) (CacheItem, bool) {
+	var ret CacheItem
+
+	s.mu.RLock()
+	item, ok := s.backend[key]
+	if ok {
+		ret = *item
+	}
+	s.mu.RUnlock()
+
+	return ret, ok
+}
+
+// Set add or replace item
+// the least recently used (or least frequently used in lfu policy) item is evicted when store is full
+func (s *LRUStore) Set(key string, item *CacheItem) {
+	item.key = key
+	item.size = int64(item.Msg.Len()+len(key)) + cacheItemOverhead
+
+	s.mu.Lock()
+	if old, ok := s.backend[key]; ok {
+		item.Hit += old.Hit
+		s.remove(old)
+	}
+
+	item.elem = s.lru.PushFront(item)
+	s.backend[key] = item
+	s.size += item.size
+
+	for s.overflow() {
+		s.remove(s.victim())
+		s.evicts++
+	}
+	s.mu.Unlock()
+}
+
+// Remove delete item
+func (s *LRUStore) Remove(key string) {
+	s.mu.Lock()
+	if item, ok := s.backend[key]; ok {
+		s.remove(item)
+	}
+	s.mu.Unlock()
+}
+
+// Length number of item
+func (s *LRUStore) Length() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.backend)
+}
+
+// Reset delete all item
+func (s *LRUStore) Reset() {
+	s.mu.Lock()
+	s.size = 0
+	s.cursor = nil
+	s.lru = list.New()
+	s.backend = make(map[string]*CacheItem, 1024)
+	s.mu.Unlock()
+}
+
+// Sweep check at most limit item and remove the item expire before the time
+// the sweep continue from the last position, so a full scan never stall the reader
+func (s *LRUStore) Sweep(expire int64, limit int) int {
+	var cnt int
+
+	s.mu.Lock()
+	var elem = s.cursor
+	if nil == elem {
+		elem = s.lru.Back()
+	}
+
+	for i := 0; i < limit && nil != elem; i++ {
+		var item = elem.Value.(*CacheItem)
+
+		elem = elem.Prev()
+		if item.Expire > 0 && item.Expire < expire {
+			s.remove(item)
+			s.expires++
+			cnt++
+		}
+	}
+	s.cursor = elem
+	s.mu.Unlock()
+
+	return cnt
+}
+
+// Range call fn with every item from the least recently used
+func (s *LRUStore) Range(fn func(item *CacheItem)) {
+	s.mu.RLock()
+	for elem := s.lru.Back(); nil != elem; elem = elem.Prev() {
+		fn(elem.Value.(*CacheItem))
+	}
+	s.mu.RUnlock()
+}
+
+// Stats get store statistics
+func (s *LRUStore) Stats() *CacheStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return &CacheStats{
+		Count:      len(s.backend),
+		Size:       s.size,
+		Evicts:     s.evicts,
+		Expires:    s.expires,
+		Prefetched: s.prefetched,
+		MaxSize:    s.maxSize,
+		MaxCount:   s.maxCount,
+		Policy:     s.policy,
+		Shards:     1,
+	}
+}
+
+// overflow check store exceed the size or count limit, must hold the write lock
+func (s *LRUStore) overflow() bool {
+	if s.lru.Len() <= 1 {
+		return false
+	}
+
+	return (s.maxCount > 0 && len(s.backend) > s.maxCount) || (s.maxSize > 0 && s.size > s.maxSize)
+}
+
+// victim pick the item to evict, must hold the write lock
+// lfu policy evict the least hit item of the least recently used samples,
+// so a popular name is not evicted by a burst of one time query
+func (s *LRUStore) victim() *CacheItem {
+	var elem = s.lru.Back()
+	var item = elem.Value.(*CacheItem)
+
+	if PolicyLFU == s.policy {
+		for i := 1; i < lfuSample; i++ {
+			if elem = elem.Prev(); nil == elem || elem == s.lru.Front() {
+				break
+			}
+
+			if v := elem.Value.(*CacheItem); v.Hit < item.Hit {
+				item = v
+			}
+		}
+	}
+
+	return item
+}
+
+// remove delete item from store, must hold the write lock
+func (s *LRUStore) remove(item *CacheItem) {
+	if s.cursor == item.elem {
+		s.cursor = item.elem.Prev()
+	}
+
+	s.lru.Remove(item.elem)
+	delete(s.backend, item.key)
+	s.size -= item.size
+}
+
+// ShardStore lock striped cache store, the item is spread to shard by hash of the key
+type ShardStore struct {
+	mask   uint64      `label:"shard index mask"`
+	shards []*LRUStore `label:"cache store shard"`
+}
+
+// NewShardStore create lock striped cache store, the shard count is round up to power of two
+// the size and count limit is split to every shard, the remainder of the count is spread to the first shards so the sum is the count limit.
+// the shard count is reduced when it is more than the count limit, every shard keep one item at least
+func NewShardStore(maxSize int64, maxCount int, policy string, count int) *ShardStore {
+	var num = 1
+	for num < count {
+		num <<= 1
+	}
+	for maxCount > 0 && num > maxCount {
+		num >>= 1
+	}
+
+	var s = &ShardStore{
+		mask:   uint64(num - 1),
+		shards: make([]*LRUStore, num),
+	}
+
+	for i := range s.shards {
+		var shardCount = maxCount / num
+		if i < maxCount%num {
+			shardCount++
+		}
+
+		s.shards[i] = NewLRUStore(maxSize/int64(num), shardCount, policy)
+	}
+
+	return s
+}
+
+// Get get item and mark it recently used
+func (s *ShardStore) Get(key string) (CacheItem, bool) {
+	return s.shard(key).Get(key)
+}
+
+// Peek get item without update the recently used list
+func (s *ShardStore) Peek(key string) (CacheItem, bool) {
+	return s.shard(key).Peek(key)
+}
+
+// Set add or replace item
+func (s *ShardStore) Set(key string, item *CacheItem) {
+	s.shard(key).Set(key, item)
+}
+
+// Remove delete item
+func (s *ShardStore) Remove(key string) {
+	s.shard(key).Remove(key)
+}
+
+// Length number of item
+func (s *ShardStore) Length() int {
+	var cnt int
+	for _, shard := range s.shards {
+		cnt += shard.Length()
+	}
+
+	return cnt
+}
+
+// Reset delete all item
+func (s *ShardStore) Reset() {
+	for _, shard := range s.shards {
+		shard.Reset()
+	}
+}
+
+// Sweep check at most limit item of every shard and remove the item expire before the time
+func (s *ShardStore) Sweep(expire int64, limit int) int {
+	var cnt int
+	for _, shard := range s.shards {
+		cnt += shard.Sweep(expire, limit)
+	}
+
+	return cnt
+}
+
+// Range call fn with every item, every shard is from the least recently used
+func (s *ShardStore) Range(fn func(item *CacheItem)) {
+	for _, shard := range s.shards {
+		shard.Range(fn)
+	}
+}
+
+// Stats get store statistics
+func (s *ShardStore) Stats() *CacheStats {
+	var ret = &CacheStats{Shards: len(s.shards)}
+	for _, shard := range s.shards {
+		var stats = shard.Stats()
+
+		ret.Count += stats.Count
+		ret.Size += stats.Size
+		ret.Evicts += stats.Evicts
+		ret.Expires += stats.Expires
+		ret.Prefetched += stats.Prefetched
+		ret.MaxSize += stats.MaxSize
+		ret.MaxCount += stats.MaxCount
+		ret.Policy = stats.Policy
+	}
+
+	return ret
+}
+
+// shard get the shard of the key by fnv-1a hash
+func (s *ShardStore) shard(key string) *LRUStore {
+	var hash uint64 = 14695981039346656037
+	for i := 0; i < len(key); i++ {
+		hash ^= uint64(key[i])
+		hash *= 1099511628211
+	}
+
+	return s.shards[hash&s.mask]
+}
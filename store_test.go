@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestShardStore(t *testing.T) {
+	var now = time.Now().Unix()
+	var store = NewShardStore(0, 100, PolicyLRU, 6)
+	if 8 != len(store.shards) {
+		t.Fatalf("shard count got %d, want 8", len(store.shards))
+	}
+
+	for i := 0; i < 1000; i++ {
+		var name = "host-" + strconv.Itoa(i) + ".example.com."
+		store.Set(name, &CacheItem{
+			Msg:    newTestMsg(name, name+" 300 IN A 192.0.2.1"),
+			Create: now - 400,
+			Expire: now - 100 + int64(i%2)*200,
+		})
+	}
+
+	var stats = store.Stats()
+	if stats.Count > 100 || stats.Count < 80 || stats.Evicts+uint64(stats.Count) != 1000 {
+		t.Errorf("shard store count limit unexpected, stats %+v", stats)
+	}
+	for _, shard := range store.shards {
+		if 0 == shard.Length() {
+			t.Errorf("shard store key is not spread to every shard")
+		}
+	}
+
+	// the shard count is reduced to the small count limit, and the sum of the shard limit is the count limit
+	var small = NewShardStore(0, 10, PolicyLRU, 16)
+	var limit int
+	for _, shard := range small.shards {
+		limit += shard.maxCount
+	}
+	if 8 != len(small.shards) || 10 != limit {
+		t.Errorf("small shard store got %d shard of %d count limit", len(small.shards), limit)
+	}
+	for i := 0; i < 100; i++ {
+		var name = "host-" + strconv.Itoa(i) + ".example.com."
+		small.Set(name, &CacheItem{Msg: newTestMsg(name, name+" 300 IN A 192.0.2.1"), Create: now, Expire: now + 300})
+	}
+	if small.Length() > 10 {
+		t.Errorf("small shard store length got %d", small.Length())
+	}
+
+	var removed int
+	for i := 0; i < 10; i++ {
+		removed += store.Sweep(now, 4)
+	}
+	if removed != stats.Count/2 || store.Length() != stats.Count-removed {
+		t.Errorf("shard store sweep removed %d item, remain %d of %d", removed, store.Length(), stats.Count)
+	}
+}
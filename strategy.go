@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+)
+
+// forwarder selection strategy name
+const (
+	StrategyRandom     = "random"
+	StrategyRoundRobin = "round-robin"
+	StrategyFastest    = "fastest"
+	StrategyWeighted   = "weighted"
+	StrategySequential = "sequential-failover"
+)
+
+// Strategy forwarder selection strategy of a group
+// the query is sent to the first forwarders of the order at the same time, the next one is used when a forwarder failed
+type Strategy interface {
+	// Select order the forwarders to query
+	Select(upstreams []Upstream) []Upstream
+	// Fanout number of forwarder to query at the same time
+	Fanout(concurrency int) int
+}
+
+// NewStrategy create forwarder selection strategy by name, empty name is random
+// weights is the weight of the forwarder address for weighted strategy, the default weight is 1
+func NewStrategy(name string, health *HealthChecker, weights map[string]int) (Strategy, error) {
+	switch name {
+	case "", StrategyRandom:
+		return &randomStrategy{}, nil
+	case StrategyRoundRobin:
+		return &roundRobinStrategy{}, nil
+	case StrategyFastest:
+		return &fastestStrategy{health: health}, nil
+	case StrategyWeighted:
+		return &weightedStrategy{weights: weights}, nil
+	case StrategySequential:
+		return &sequentialStrategy{}, nil
+	}
+
+	return nil, errors.New("proxy: not support forwarder strategy " + name)
+}
+
+// rotate order the forwarders start from the index
+func rotate(upstreams []Upstream, idx int) []Upstream {
+	var cnt = len(upstreams)
+	var ret = make([]Upstream, cnt)
+	for i := 0; i < cnt; i++ {
+		ret[i] = upstreams[(idx+i)%cnt]
+	}
+
+	return ret
+}
+
+// randomStrategy start from random forwarder
+type randomStrategy struct{}
+
+// Select order the forwarders start from random index
+func (r *randomStrategy) Select(upstreams []Upstream) []Upstream {
+	if 0 == len(upstreams) {
+		return upstreams
+	}
+
+	return rotate(upstreams, rand.Intn(len(upstreams)))
+}
+
+// Fanout query the forwarders at the same time
+func (r *randomStrategy) Fanout(concurrency int) int {
+	return concurrency
+}
+
+// roundRobinStrategy start from the next forwarder of the last query
+type roundRobinStrategy struct {
+	next uint64 `label:"query counter"`
+}
+
+// Select order the forwarders start from the next index
+func (r *roundRobinStrategy) Select(upstreams []Upstream) []Upstream {
+	if 0 == len(upstreams) {
+		return upstreams
+	}
+
+	var idx = atomic.AddUint64(&r.next, 1) - 1
+
+	return rotate(upstreams, int(idx%uint64(len(upstreams))))
+}
+
+// Fanout query the forwarders at the same time
+func (r *roundRobinStrategy) Fanout(concurrency int) int {
+	return concurrency
+}
+
+// fastestStrategy order the forwarders by the moving average latency of the health checker
+// the forwarder not measured yet is used first, so every forwarder get a latency sample
+type fastestStrategy struct {
+	health *HealthChecker `label:"forwarder latency source"`
+}
+
+// Select order the forwarders by latency
+func (f *fastestStrategy) Select(upstreams []Upstream) []Upstream {
+	var latency = make(map[Upstream]int64, len(upstreams))
+	for _, upstream := range upstreams {
+		latency[upstream] = int64(f.health.Latency(upstream))
+	}
+
+	var ret = append([]Upstream{}, upstreams...)
+	sort.SliceStable(ret, func(i, j int) bool {
+		return latency[ret[i]] < latency[ret[j]]
+	})
+
+	return ret
+}
+
+// Fanout query the forwarders at the same time
+func (f *fastestStrategy) Fanout(concurrency int) int {
+	return concurrency
+}
+
+// weightedStrategy random order the forwarders, the forwarder of large weight is more likely in front
+type weightedStrategy struct {
+	weights map[string]int `label:"weight of forwarder address"`
+}
+
+// Select order the forwarders by weighted random sampling, the key of every forwarder is random ^ (1 / weight)
+func (w *weightedStrategy) Select(upstreams []Upstream) []Upstream {
+	var keys = make(map[Upstream]float64, len(upstreams))
+	for _, upstream := range upstreams {
+		var weight = w.weights[upstream.Address()]
+		if weight <= 0 {
+			weight = 1
+		}
+
+		keys[upstream] = math.Pow(rand.Float64(), 1/float64(weight))
+	}
+
+	var ret = append([]Upstream{}, upstreams...)
+	sort.Slice(ret, func(i, j int) bool {
+		return keys[ret[i]] > keys[ret[j]]
+	})
+
+	return ret
+}
+
+// Fanout query the forwarders at the same time
+func (w *weightedStrategy) Fanout(concurrency int) int {
+	return concurrency
+}
+
+// upstreamWeights get the weight of the forwarder transport address, the upstreams is created from the servers of the group in order.
+// the weight config key is the server address of the group config, the transport address with scheme is matched too
+func upstreamWeights(option *ForwarderGroup, upstreams []Upstream, weights map[string]int) map[string]int {
+	var ret = make(map[string]int, len(upstreams))
+	for i, upstream := range upstreams {
+		if weight, ok := weights[upstream.Address()]; ok {
+			ret[upstream.Address()] = weight
+		} else if weight, ok = weights[option.Servers[i]]; ok {
+			ret[upstream.Address()] = weight
+		}
+	}
+
+	return ret
+}
+
+// sequentialStrategy query the forwarders one by one in config order, the next one is used only when the previous failed
+type sequentialStrategy struct{}
+
+// Select keep the config order
+func (q *sequentialStrategy) Select(upstreams []Upstream) []Upstream {
+	return upstreams
+}
+
+// Fanout query one forwarder at a time
+func (q *sequentialStrategy) Fanout(int) int {
+	return 1
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestStrategySelect(t *testing.T) {
+	var a, b, c = &testUpstream{addr: "a"}, &testUpstream{addr: "b"}, &testUpstream{addr: "c"}
+	var all = []Upstream{a, b, c}
+	var health = NewHealthChecker(3, time.Second, time.Minute, ".")
+	defer health.Close()
+	for _, upstream := range all {
+		health.Add(upstream, time.Second)
+	}
+
+	var rr, _ = NewStrategy(StrategyRoundRobin, health, nil)
+	for i := 0; i < 6; i++ {
+		if first := rr.Select(all)[0]; first != all[i%3] {
+			t.Errorf("round-robin query %d start from %s", i, first.Address())
+		}
+	}
+
+	var seq, _ = NewStrategy(StrategySequential, health, nil)
+	if ret := seq.Select(all); ret[0] != a || ret[2] != c || 1 != seq.Fanout(3) {
+		t.Error("sequential-failover should keep config order and query one forwarder at a time")
+	}
+
+	// the forwarder not measured is used first, then the fastest
+	health.Record(a, 30*time.Millisecond, nil)
+	health.Record(b, 10*time.Millisecond, nil)
+	var fastest, _ = NewStrategy(StrategyFastest, health, nil)
+	if ret := fastest.Select(all); ret[0] != c || ret[1] != b || ret[2] != a {
+		t.Errorf("fastest order got %s %s %s", ret[0].Address(), ret[1].Address(), ret[2].Address())
+	}
+
+	var weighted, _ = NewStrategy(StrategyWeighted, health, map[string]int{"a": 8})
+	var count = make(map[Upstream]int)
+	for i := 0; i < 1000; i++ {
+		count[weighted.Select(all)[0]]++
+	}
+	if count[a] < 600 || 0 == count[b] || 0 == count[c] {
+		t.Errorf("weighted first forwarder count got a %d b %d c %d", count[a], count[b], count[c])
+	}
+
+	if _, err := NewStrategy("nearest", health, nil); nil == err {
+		t.Error("unknown strategy should failed")
+	}
+}
+
+func TestUpstreamWeights(t *testing.T) {
+	var option = &ForwarderGroup{Servers: []string{"8.8.8.8:53", "1.1.1.1:53", "9.9.9.9"}, Protocol: "tcp"}
+	if err := option.Init(3); nil != err {
+		t.Fatal(err)
+	}
+
+	var upstreams []Upstream
+	for _, addr := range option.Servers {
+		var upstream, err = NewUpstream(option.Address(addr), time.Second)
+		if nil != err {
+			t.Fatal(err)
+		}
+		defer upstream.Close()
+
+		upstreams = append(upstreams, upstream)
+	}
+
+	// the weight is configured by the server address of the group, or the transport address with scheme
+	var weights = upstreamWeights(option, upstreams, map[string]int{"8.8.8.8:53": 1000, "tcp://9.9.9.9": 3, "4.4.4.4:53": 7})
+	if 2 != len(weights) || 1000 != weights["tcp://8.8.8.8:53"] || 3 != weights["tcp://9.9.9.9"] {
+		t.Fatalf("upstream weight got %v", weights)
+	}
+
+	var weighted, _ = NewStrategy(StrategyWeighted, nil, weights)
+	var count int
+	for i := 0; i < 100; i++ {
+		if upstreams[0] == weighted.Select(upstreams)[0] {
+			count++
+		}
+	}
+	if count < 90 {
+		t.Errorf("weighted forwarder of plain address is first %d times", count)
+	}
+}
+
+func TestExchangeFailover(t *testing.T) {
+	var a, b = &testUpstream{addr: "a", down: 1}, &testUpstream{addr: "b"}
+	var s = newTestService()
+	s.config.Rules = map[string]string{"default": "normal"}
+	s.config.Forwarders = map[string]*ForwarderGroup{"normal": {Servers: []string{"a", "b"}, Timeout: 1000, AttemptTimeout: 500, Concurrency: 3, Retries: 1}}
+	s.upstreams = map[string][]Upstream{"normal": {a, b}}
+	s.strategy = map[string]Strategy{"normal": &sequentialStrategy{}}
+	s.health.Add(a, time.Second)
+	s.health.Add(b, time.Second)
+
+	var req = new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	if msg, err := s.exchange("test", req); nil != err || nil == msg {
+		t.Fatalf("sequential failover exchange error: %v", err)
+	}
+	var stats = s.health.Stats()
+	if 1 != stats[0].Failure || 1 != stats[1].Success {
+		t.Errorf("sequential failover should query a then b, stats %+v", stats)
+	}
+
+	atomic.StoreInt32(&b.down, 1)
+	if _, err := s.exchange("test", req); ErrForwarderFailed != err {
+		t.Errorf("every forwarder failed got error %v", err)
+	}
+	if stats = s.health.Stats(); 3 != stats[0].Failure || 2 != stats[1].Failure {
+		t.Errorf("failed group should be retried once, stats %+v", stats)
+	}
+
+	// the silent forwarder is not waited until the group timeout
+	atomic.StoreInt32(&a.down, 0)
+	atomic.StoreInt32(&a.block, 1)
+	atomic.StoreInt32(&b.down, 0)
+	s.config.Forwarders["normal"].AttemptTimeout = 50
+	var start = time.Now()
+	if msg, err := s.exchange("test", req); nil != err || nil == msg {
+		t.Fatalf("blocked forwarder exchange error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("next forwarder should be queried after the attempt timeout, elapsed %s", elapsed)
+	}
+	if stats = s.health.Stats(); 2 != stats[1].Success {
+		t.Errorf("blocked forwarder should fail over to b, stats %+v", stats)
+	}
+}
+
+func TestExchangeServerFailure(t *testing.T) {
+	var a, b = &testUpstream{addr: "a", rcode: dns.RcodeServerFailure}, &testUpstream{addr: "b"}
+	var s = newTestService()
+	s.config.Rules = map[string]string{"default": "normal"}
+	s.config.Forwarders = map[string]*ForwarderGroup{"normal": {Servers: []string{"a", "b"}, Timeout: 1000, AttemptTimeout: 500, Concurrency: 1}}
+	s.upstreams = map[string][]Upstream{"normal": {a, b}}
+	s.strategy = map[string]Strategy{"normal": &sequentialStrategy{}}
+	s.health.Add(a, time.Second)
+	s.health.Add(b, time.Second)
+
+	var req = new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	if msg, err := s.exchange("test", req); nil != err || dns.RcodeSuccess != msg.Msg.Rcode {
+		t.Fatalf("SERVFAIL forwarder should fail over, got %v %v", msg, err)
+	}
+	var stats = s.health.Stats()
+	if 1 != stats[0].Failure || 0 != stats[0].Success || 1 != stats[1].Success {
+		t.Errorf("SERVFAIL should be the failure of the forwarder, stats %+v", stats)
+	}
+
+	// the answer of the last failed forwarder is passed to the client
+	atomic.StoreInt32(&b.rcode, dns.RcodeRefused)
+	if msg, err := s.exchange("test", req); nil != err || dns.RcodeRefused != msg.Msg.Rcode {
+		t.Errorf("every forwarder refused got %v %v", msg, err)
+	}
+	if stats = s.health.Stats(); 2 != stats[0].Failure || 1 != stats[1].Failure {
+		t.Errorf("REFUSED should be the failure of the forwarder, stats %+v", stats)
+	}
+}
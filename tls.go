@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"sync"
+)
+
+// CertStore tls certificate store of encrypted dns listener
+// the listener get certificate from the store on every handshake, so the certificate can be reload without restart
+type CertStore struct {
+	mu   *sync.RWMutex    `label:"certificate read & write lock"`
+	cert *tls.Certificate `label:"current certificate"`
+}
+
+// NewCertStore create empty certificate store
+func NewCertStore() *CertStore {
+	return &CertStore{
+		mu: new(sync.RWMutex),
+	}
+}
+
+// Load read certificate chain and private key file, the old certificate is kept when load failed
+func (c *CertStore) Load(option *TLSOption) error {
+	var cert, err = tls.LoadX509KeyPair(option.Cert, option.Key)
+	if nil != err {
+		return errors.New("proxy: load tls certificate " + option.Cert + " failed, " + err.Error())
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+
+	return nil
+}
+
+// Ready certificate is loaded
+func (c *CertStore) Ready() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return nil != c.cert
+}
+
+// GetCertificate get current certificate for tls handshake
+func (c *CertStore) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if nil == c.cert {
+		return nil, errors.New("proxy: tls certificate is not loaded")
+	}
+
+	return c.cert, nil
+}
+
+// TLSConfig create tls config use the certificate of the store
+func (c *CertStore) TLSConfig(protos ...string) *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     protos,
+		GetCertificate: c.GetCertificate,
+	}
+}
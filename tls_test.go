@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// writeTestCert create self-signed certificate for loopback listener test
+func writeTestCert(t *testing.T, name string) *TLSOption {
+	var key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	var tpl = &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if nil != err {
+		t.Fatal(err)
+	}
+	raw, err := x509.MarshalECPrivateKey(key)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	var dir = t.TempDir()
+	var option = &TLSOption{
+		Cert:        filepath.Join(dir, "server.crt"),
+		Key:         filepath.Join(dir, "server.key"),
+		IdleTimeout: 10,
+	}
+	if err = os.WriteFile(option.Cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); nil != err {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(option.Key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: raw}), 0600); nil != err {
+		t.Fatal(err)
+	}
+
+	return option
+}
+
+func TestTLSServer(t *testing.T) {
+	var service = newTestService("a.example.com. 300 IN A 192.0.2.1", "b.example.com. 300 IN A 192.0.2.2")
+	service.cert = NewCertStore()
+	service.config.TLS = writeTestCert(t, "dns-a.test")
+	if err := service.cert.Load(service.config.TLS); nil != err {
+		t.Fatal(err)
+	}
+
+	var handle, ok = NewTLSServer(service, "tls", "127.0.0.1:0")
+	if !ok {
+		t.Fatal("create tls server failed")
+	}
+	var server = handle.(*TLSServer)
+	go server.Start()
+	defer server.Stop()
+
+	var addr string
+	for i := 0; i < 100 && "" == addr; i++ {
+		time.Sleep(10 * time.Millisecond)
+		server.mu.Lock()
+		if nil != server.listener {
+			addr = server.listener.Addr().String()
+		}
+		server.mu.Unlock()
+	}
+
+	var dial = func() (*dns.Conn, string) {
+		var conn, err = tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+		if nil != err {
+			t.Fatal(err)
+		}
+
+		return &dns.Conn{Conn: conn}, conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+
+	// pipeline two query on one connection before read the answer
+	var conn, name = dial()
+	if "dns-a.test" != name {
+		t.Errorf("tls server certificate got %s, want dns-a.test", name)
+	}
+	for i, host := range []string{"a.example.com.", "b.example.com."} {
+		var req = new(dns.Msg)
+		req.SetQuestion(host, dns.TypeA)
+		req.Id = uint16(i + 1)
+		if err := conn.WriteMsg(req); nil != err {
+			t.Fatal(err)
+		}
+	}
+	var ids = make(map[uint16]bool)
+	for i := 0; i < 2; i++ {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		var resp, err = conn.ReadMsg()
+		if nil != err || 1 != len(resp.Answer) {
+			t.Fatalf("tls server answer got %v %v", resp, err)
+		}
+		ids[resp.Id] = true
+	}
+	if !ids[1] || !ids[2] {
+		t.Errorf("tls server pipeline answer id got %v", ids)
+	}
+	conn.Close()
+
+	// new connection use the reloaded certificate
+	if err := service.cert.Load(writeTestCert(t, "dns-b.test")); nil != err {
+		t.Fatal(err)
+	}
+	conn, name = dial()
+	if "dns-b.test" != name {
+		t.Errorf("tls server reload certificate got %s, want dns-b.test", name)
+	}
+	conn.Close()
+}
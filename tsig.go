@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// TSIGKeys TSIG secret of the key name (RFC 8945), the secret is base64 encoded like the key of BIND and nsupdate
+// it is the TsigProvider of the name server, so the transaction of zone transfer and dynamic update is signed and verified
+type TSIGKeys map[string]string
+
+// NewTSIGKeys check the TSIG secret, the key name is the lower case fqdn
+func NewTSIGKeys(keys map[string]string) (TSIGKeys, error) {
+	var ret = make(TSIGKeys, len(keys))
+	for name, secret := range keys {
+		if _, err := base64.StdEncoding.DecodeString(secret); nil != err || "" == secret {
+			return nil, errors.New("proxy: tsig key " + name + " secret is not base64 encoded")
+		}
+
+		ret[dns.CanonicalName(name)] = secret
+	}
+
+	return ret, nil
+}
+
+// Generate compute the HMAC of the message by the secret of the TSIG key name
+func (k TSIGKeys) Generate(msg []byte, t *dns.TSIG) ([]byte, error) {
+	var secret, ok = k[dns.CanonicalName(t.Hdr.Name)]
+	if !ok {
+		return nil, dns.ErrSecret
+	}
+
+	var raw, err = base64.StdEncoding.DecodeString(secret)
+	if nil != err {
+		return nil, err
+	}
+
+	var h hash.Hash
+	switch strings.ToLower(dns.Fqdn(t.Algorithm)) {
+	case dns.HmacSHA1:
+		h = hmac.New(sha1.New, raw)
+	case dns.HmacSHA224:
+		h = hmac.New(sha256.New224, raw)
+	case dns.HmacSHA256:
+		h = hmac.New(sha256.New, raw)
+	case dns.HmacSHA384:
+		h = hmac.New(sha512.New384, raw)
+	case dns.HmacSHA512:
+		h = hmac.New(sha512.New, raw)
+	default:
+		return nil, dns.ErrKeyAlg
+	}
+	h.Write(msg)
+
+	return h.Sum(nil), nil
+}
+
+// Verify check the HMAC of the message
+func (k TSIGKeys) Verify(msg []byte, t *dns.TSIG) error {
+	var sum, err = k.Generate(msg, t)
+	if nil != err {
+		return err
+	}
+
+	var mac []byte
+	if mac, err = hex.DecodeString(t.MAC); nil != err {
+		return err
+	}
+	if !hmac.Equal(sum, mac) {
+		return dns.ErrSig
+	}
+
+	return nil
+}
+
+// tsigKey get the key name of the verified TSIG of the request, empty is not signed or failed to verify
+func tsigKey(req *dns.Msg, status error) string {
+	if tsig := req.IsTsig(); nil != tsig && nil == status {
+		return dns.CanonicalName(tsig.Hdr.Name)
+	}
+
+	return ""
+}
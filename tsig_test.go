@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestTSIGKeys(t *testing.T) {
+	if _, err := NewTSIGKeys(map[string]string{"bad.key": "not base64!"}); nil == err {
+		t.Error("tsig key with invalid secret should be rejected")
+	}
+
+	var keys, err = NewTSIGKeys(map[string]string{"Update.Key": "c2VjcmV0"})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	for _, alg := range []string{dns.HmacSHA1, dns.HmacSHA256, dns.HmacSHA512} {
+		var req = new(dns.Msg)
+		req.SetQuestion("www.corp.example.", dns.TypeA)
+		req.SetTsig("update.key.", alg, 300, time.Now().Unix())
+
+		var buf, _, err = dns.TsigGenerateWithProvider(req, keys, "", false)
+		if nil != err {
+			t.Fatalf("tsig %s generate error: %v", alg, err)
+		}
+		// verify strip the TSIG of the buffer in place
+		if err = dns.TsigVerify(append([]byte{}, buf...), "c2VjcmV0", "", false); nil != err {
+			t.Errorf("tsig %s verify error: %v", alg, err)
+		}
+		if err = dns.TsigVerifyWithProvider(append([]byte{}, buf...), keys, "", false); nil != err {
+			t.Errorf("tsig %s verify by provider error: %v", alg, err)
+		}
+
+		var msg = new(dns.Msg)
+		msg.Unpack(buf)
+		if key := tsigKey(msg, nil); "update.key." != key {
+			t.Errorf("tsig key name got %s", key)
+		}
+	}
+
+	var req = new(dns.Msg)
+	req.SetQuestion("www.corp.example.", dns.TypeA)
+	req.SetTsig("other.key.", dns.HmacSHA256, 300, time.Now().Unix())
+	if _, _, err = dns.TsigGenerateWithProvider(req, keys, "", false); dns.ErrSecret != err {
+		t.Errorf("tsig unknown key got %v", err)
+	}
+}
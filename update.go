@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Update apply the RFC 2136 dynamic update of the request to the zone, the rcode of the update is returned
+// the change is written to the journal before apply, and the SOA serial is increased when the zone is changed
+func (z *Zone) Update(req *dns.Msg) (int, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	if rcode := z.prerequisite(req.Answer); dns.RcodeSuccess != rcode {
+		return rcode, nil
+	}
+	if rcode := z.prescan(req.Ns); dns.RcodeSuccess != rcode {
+		return rcode, nil
+	}
+
+	var del, add = z.diff(req.Ns)
+	if 0 == len(del) && 0 == len(add) {
+		return dns.RcodeSuccess, nil
+	}
+
+	// the serial is increased unless the update give a newer SOA
+	if 0 == len(add) || dns.TypeSOA != add[0].Header().Rrtype {
+		var soa = dns.Copy(z.SOA).(*dns.SOA)
+		soa.Serial++
+		del = append([]dns.RR{z.SOA}, del...)
+		add = append([]dns.RR{soa}, add...)
+	}
+
+	if err := z.writeJournal(del, add); nil != err {
+		return dns.RcodeServerFailure, err
+	}
+	z.apply(del, add)
+
+	return dns.RcodeSuccess, nil
+}
+
+// prerequisite check the prerequisite section of the update (RFC 2136 3.2)
+func (z *Zone) prerequisite(rrs []dns.RR) int {
+	var sets = make(map[string][]dns.RR)
+	for _, rr := range rrs {
+		var hdr = rr.Header()
+		var name = strings.ToLower(hdr.Name)
+		if 0 != hdr.Ttl {
+			return dns.RcodeFormatError
+		}
+		if !dns.IsSubDomain(z.Origin, name) {
+			return dns.RcodeNotZone
+		}
+
+		switch hdr.Class {
+		case dns.ClassANY:
+			if 0 != hdr.Rdlength {
+				return dns.RcodeFormatError
+			}
+			if dns.TypeANY == hdr.Rrtype && 0 == len(z.records[name]) {
+				return dns.RcodeNameError
+			}
+			if dns.TypeANY != hdr.Rrtype && 0 == len(z.rrset(name, hdr.Rrtype)) {
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if 0 != hdr.Rdlength {
+				return dns.RcodeFormatError
+			}
+			if dns.TypeANY == hdr.Rrtype && 0 != len(z.records[name]) {
+				return dns.RcodeYXDomain
+			}
+			if dns.TypeANY != hdr.Rrtype && 0 != len(z.rrset(name, hdr.Rrtype)) {
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			var key = name + "/" + dns.TypeToString[hdr.Rrtype]
+			sets[key] = append(sets[key], updateRecord(rr))
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	// the value dependent RRset must be the same as the zone RRset
+	for _, set := range sets {
+		var current = z.rrset(set[0].Header().Name, set[0].Header().Rrtype)
+		if !sameRRset(set, current) {
+			return dns.RcodeNXRrset
+		}
+	}
+
+	return dns.RcodeSuccess
+}
+
+// prescan check the update section before apply any change (RFC 2136 3.4.1)
+func (z *Zone) prescan(rrs []dns.RR) int {
+	for _, rr := range rrs {
+		var hdr = rr.Header()
+		if !dns.IsSubDomain(z.Origin, strings.ToLower(hdr.Name)) {
+			return dns.RcodeNotZone
+		}
+
+		switch hdr.Rrtype {
+		case dns.TypeAXFR, dns.TypeIXFR, dns.TypeMAILA, dns.TypeMAILB, dns.TypeTSIG, dns.TypeOPT:
+			return dns.RcodeFormatError
+		}
+
+		switch hdr.Class {
+		case dns.ClassINET:
+			if dns.TypeANY == hdr.Rrtype {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassANY:
+			if 0 != hdr.Ttl || 0 != hdr.Rdlength {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassNONE:
+			if 0 != hdr.Ttl || dns.TypeANY == hdr.Rrtype {
+				return dns.RcodeFormatError
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	return dns.RcodeSuccess
+}
+
+// diff get the deleted and added record of the update section, the update is applied in order on a copy of the changed name
+// the SOA is the first record of the change when it is replaced by a newer serial
+func (z *Zone) diff(rrs []dns.RR) ([]dns.RR, []dns.RR) {
+	var work = make(map[string][]dns.RR)
+	var get = func(name string) []dns.RR {
+		if set, ok := work[name]; ok {
+			return set
+		}
+
+		return append([]dns.RR{}, z.records[name]...)
+	}
+
+	for _, rr := range rrs {
+		var hdr = rr.Header()
+		var name = strings.ToLower(hdr.Name)
+		var set = get(name)
+		var apex = name == z.Origin
+
+		switch hdr.Class {
+		case dns.ClassINET:
+			set = updateAdd(set, updateRecord(rr))
+		case dns.ClassANY:
+			set = updateFilter(set, func(v dns.RR) bool {
+				var t = v.Header().Rrtype
+				if apex && (dns.TypeSOA == t || dns.TypeNS == t) {
+					return true
+				}
+
+				return dns.TypeANY != hdr.Rrtype && t != hdr.Rrtype
+			})
+		case dns.ClassNONE:
+			var target = updateRecord(rr)
+			if dns.TypeSOA == hdr.Rrtype || apex && dns.TypeNS == hdr.Rrtype && 1 == len(rrsetOf(set, dns.TypeNS)) {
+				break
+			}
+			set = updateFilter(set, func(v dns.RR) bool {
+				return !dns.IsDuplicate(v, target)
+			})
+		}
+
+		work[name] = set
+	}
+
+	var del, add []dns.RR
+	for name, set := range work {
+		for _, rr := range z.records[name] {
+			if !containsRR(set, rr) {
+				del = append(del, rr)
+			}
+		}
+		for _, rr := range set {
+			if !containsRR(z.records[name], rr) {
+				add = append(add, rr)
+			}
+		}
+	}
+
+	return sortSOA(del), sortSOA(add)
+}
+
+// rrset get the record of the name and type
+func (z *Zone) rrset(name string, rrtype uint16) []dns.RR {
+	return rrsetOf(z.records[name], rrtype)
+}
+
+// rrsetOf get the record of the type in the record list
+func rrsetOf(rrs []dns.RR, rrtype uint16) []dns.RR {
+	var ret []dns.RR
+	for _, rr := range rrs {
+		if rrtype == rr.Header().Rrtype {
+			ret = append(ret, rr)
+		}
+	}
+
+	return ret
+}
+
+// apply delete and add the record, then rebuild the owner name, SOA and NS of the zone
+func (z *Zone) apply(del []dns.RR, add []dns.RR) {
+	for _, rr := range del {
+		var name = rr.Header().Name
+		var set = updateFilter(z.records[name], func(v dns.RR) bool {
+			return !dns.IsDuplicate(v, rr)
+		})
+		if 0 == len(set) {
+			delete(z.records, name)
+		} else {
+			z.records[name] = set
+		}
+	}
+
+	z.SOA, z.NS = nil, nil
+	z.names = make(map[string]bool, len(z.records))
+	var records = z.records
+	z.records = make(map[string][]dns.RR, len(records))
+	for _, rrs := range records {
+		for _, rr := range rrs {
+			z.Add(rr)
+		}
+	}
+	for _, rr := range add {
+		z.Add(rr)
+	}
+}
+
+// writeJournal append the change to the journal file, the deleted record is prefixed by - and the added record by +
+// every change start with the deleted SOA and end with an empty line, so the incomplete change is skipped on replay
+func (z *Zone) writeJournal(del []dns.RR, add []dns.RR) error {
+	var fp, err = os.OpenFile(z.journal, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if nil != err {
+		return err
+	}
+	defer fp.Close()
+
+	var buf strings.Builder
+	for _, rr := range del {
+		buf.WriteString("-" + rr.String() + "\n")
+	}
+	for _, rr := range add {
+		buf.WriteString("+" + rr.String() + "\n")
+	}
+	buf.WriteString("\n")
+
+	if _, err = fp.WriteString(buf.String()); nil != err {
+		return err
+	}
+
+	return fp.Sync()
+}
+
+// replay apply the change of the journal, the change not start from the current serial is skipped,
+// so the journal is ignored after the zone file is edited with a new serial.
+// the last change without the ending empty line is written partly when the process exit, it is skipped too
+func (z *Zone) replay() error {
+	var fp, err = os.Open(z.journal)
+	if os.IsNotExist(err) {
+		return nil
+	} else if nil != err {
+		return err
+	}
+	defer fp.Close()
+
+	var del, add []dns.RR
+	var invalid string
+	var scanner = bufio.NewScanner(fp)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var line = scanner.Text()
+		if "" == line {
+			if "" != invalid {
+				return errors.New("proxy: zone " + z.Origin + " journal " + z.journal + " is invalid, " + invalid)
+			}
+			if soa, ok := journalSOA(del); ok && soa.Serial == z.SOA.Serial {
+				z.apply(del, add)
+			}
+			del, add = nil, nil
+
+			continue
+		}
+
+		var rr, err = dns.NewRR(line[1:])
+		if nil != err || nil == rr || ('-' != line[0] && '+' != line[0]) {
+			invalid = line
+
+			continue
+		}
+
+		rr.Header().Name = strings.ToLower(rr.Header().Name)
+		if '-' == line[0] {
+			del = append(del, rr)
+		} else {
+			add = append(add, rr)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// journalSOA get the deleted SOA of the journal change
+func journalSOA(del []dns.RR) (*dns.SOA, bool) {
+	if 0 == len(del) {
+		return nil, false
+	}
+
+	var soa, ok = del[0].(*dns.SOA)
+
+	return soa, ok
+}
+
+// updateRecord copy the update record as the zone record, the owner name is lower case and the class is IN
+func updateRecord(rr dns.RR) dns.RR {
+	var ret = dns.Copy(rr)
+	ret.Header().Name = strings.ToLower(ret.Header().Name)
+	ret.Header().Class = dns.ClassINET
+
+	return ret
+}
+
+// updateAdd add the record to the record list of the name (RFC 2136 3.4.2.2)
+// the SOA is replaced only by a newer serial, CNAME and other data can not be at the same name, and the duplicate is ignored
+func updateAdd(set []dns.RR, rr dns.RR) []dns.RR {
+	var rrtype = rr.Header().Rrtype
+	for i, v := range set {
+		var t = v.Header().Rrtype
+		switch {
+		case dns.TypeSOA == rrtype && dns.TypeSOA == t:
+			if serialNewer(rr.(*dns.SOA).Serial, v.(*dns.SOA).Serial) {
+				set[i] = rr
+			}
+
+			return set
+		case dns.TypeCNAME == rrtype && dns.TypeCNAME == t:
+			set[i] = rr
+
+			return set
+		case dns.TypeCNAME == rrtype || dns.TypeCNAME == t:
+			return set
+		case dns.IsDuplicate(v, rr):
+			return set
+		}
+	}
+	if dns.TypeSOA == rrtype {
+		return set
+	}
+
+	return append(set, rr)
+}
+
+// updateFilter get the record of the list the keep function return true
+func updateFilter(set []dns.RR, keep func(dns.RR) bool) []dns.RR {
+	var ret = make([]dns.RR, 0, len(set))
+	for _, rr := range set {
+		if keep(rr) {
+			ret = append(ret, rr)
+		}
+	}
+
+	return ret
+}
+
+// containsRR check the record is in the list, the ttl is ignored
+func containsRR(set []dns.RR, rr dns.RR) bool {
+	for _, v := range set {
+		if dns.IsDuplicate(v, rr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sameRRset check the two RRset have the same record
+func sameRRset(a []dns.RR, b []dns.RR) bool {
+	for _, rr := range a {
+		if !containsRR(b, rr) {
+			return false
+		}
+	}
+	for _, rr := range b {
+		if !containsRR(a, rr) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sortSOA move the SOA to the front of the record list
+func sortSOA(rrs []dns.RR) []dns.RR {
+	for i, rr := range rrs {
+		if dns.TypeSOA == rr.Header().Rrtype {
+			rrs[0], rrs[i] = rrs[i], rrs[0]
+
+			break
+		}
+	}
+
+	return rrs
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestZoneUpdate(t *testing.T) {
+	var path = filepath.Join(t.TempDir(), "corp.zone")
+	if err := os.WriteFile(path, []byte(testZone), 0644); nil != err {
+		t.Fatal(err)
+	}
+
+	var option = &ZoneOption{Name: "corp.example.", File: path, UpdateKey: "update.key."}
+	if err := option.Init(); nil != err || path+".jnl" != option.Journal {
+		t.Fatalf("zone option init got journal %s %v", option.Journal, err)
+	}
+
+	var zone, err = NewZone(option)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	var rr = func(s string) dns.RR {
+		var ret, _ = dns.NewRR(s)
+		return ret
+	}
+	var update = func(prepare func(msg *dns.Msg)) int {
+		var msg = new(dns.Msg)
+		msg.SetUpdate("corp.example.")
+		prepare(msg)
+
+		var rcode, err = zone.Update(msg)
+		if nil != err {
+			t.Fatal(err)
+		}
+
+		return rcode
+	}
+	var lookup = func(name string, qtype uint16) *dns.Msg {
+		var req = new(dns.Msg)
+		req.SetQuestion(name, qtype)
+
+		return zone.Answer(req)
+	}
+
+	var cases = []struct {
+		name    string
+		prepare func(msg *dns.Msg)
+		rcode   int
+		serial  uint32
+	}{
+		{"add record", func(msg *dns.Msg) {
+			msg.Insert([]dns.RR{rr("host.corp.example. 300 IN A 10.0.1.1"), rr("host.corp.example. 300 IN A 10.0.1.2")})
+		}, dns.RcodeSuccess, 2024010102},
+		{"add duplicate record", func(msg *dns.Msg) {
+			msg.Insert([]dns.RR{rr("host.corp.example. 300 IN A 10.0.1.1")})
+		}, dns.RcodeSuccess, 2024010102},
+		{"name not used prerequisite", func(msg *dns.Msg) {
+			msg.NameNotUsed([]dns.RR{rr("host.corp.example. 300 IN A 10.0.1.1")})
+			msg.Insert([]dns.RR{rr("host.corp.example. 300 IN A 10.0.1.3")})
+		}, dns.RcodeYXDomain, 2024010102},
+		{"rrset used prerequisite", func(msg *dns.Msg) {
+			msg.RRsetUsed([]dns.RR{rr("host.corp.example. 300 IN AAAA fd00::1")})
+		}, dns.RcodeNXRrset, 2024010102},
+		{"value dependent prerequisite", func(msg *dns.Msg) {
+			msg.Used([]dns.RR{rr("host.corp.example. 300 IN A 10.0.1.1"), rr("host.corp.example. 300 IN A 10.0.1.2")})
+			msg.Remove([]dns.RR{rr("host.corp.example. 300 IN A 10.0.1.2")})
+		}, dns.RcodeSuccess, 2024010103},
+		{"cname with other data", func(msg *dns.Msg) {
+			msg.Insert([]dns.RR{rr("host.corp.example. 300 IN CNAME www.corp.example.")})
+		}, dns.RcodeSuccess, 2024010103},
+		{"remove rrset", func(msg *dns.Msg) {
+			msg.RemoveRRset([]dns.RR{rr("www.corp.example. 300 IN AAAA fd00::2")})
+		}, dns.RcodeSuccess, 2024010104},
+		{"remove name", func(msg *dns.Msg) {
+			msg.RemoveName([]dns.RR{rr("git.corp.example. 300 IN A 10.0.1.1")})
+		}, dns.RcodeSuccess, 2024010105},
+		{"remove apex soa and ns", func(msg *dns.Msg) {
+			msg.RemoveName([]dns.RR{rr("corp.example. 300 IN A 10.0.1.1")})
+		}, dns.RcodeSuccess, 2024010106},
+		{"newer soa", func(msg *dns.Msg) {
+			msg.Insert([]dns.RR{rr("corp.example. 600 IN SOA ns1.corp.example. admin.corp.example. 2024020101 3600 600 86400 60")})
+		}, dns.RcodeSuccess, 2024020101},
+		{"out of zone", func(msg *dns.Msg) {
+			msg.Insert([]dns.RR{rr("www.example.org. 300 IN A 10.0.1.1")})
+		}, dns.RcodeNotZone, 2024020101},
+		{"add any type", func(msg *dns.Msg) {
+			msg.Ns = append(msg.Ns, &dns.ANY{Hdr: dns.RR_Header{Name: "x.corp.example.", Rrtype: dns.TypeANY, Class: dns.ClassINET}})
+		}, dns.RcodeFormatError, 2024020101},
+	}
+	for _, c := range cases {
+		if rcode := update(c.prepare); c.rcode != rcode || c.serial != zone.SOA.Serial {
+			t.Errorf("update %s got %s serial %d", c.name, dns.RcodeToString[rcode], zone.SOA.Serial)
+		}
+	}
+
+	if resp := lookup("host.corp.example.", dns.TypeA); 1 != len(resp.Answer) || "10.0.1.1" != resp.Answer[0].(*dns.A).A.String() {
+		t.Errorf("updated host got %v", resp.Answer)
+	}
+	if resp := lookup("git.corp.example.", dns.TypeA); dns.RcodeNameError != resp.Rcode {
+		t.Errorf("removed name got %s", dns.RcodeToString[resp.Rcode])
+	}
+	if resp := lookup("corp.example.", dns.TypeMX); 0 != len(resp.Answer) {
+		t.Errorf("removed apex mx got %v", resp.Answer)
+	}
+	if resp := lookup("corp.example.", dns.TypeNS); 1 != len(resp.Answer) {
+		t.Errorf("apex ns should be kept, got %v", resp.Answer)
+	}
+
+	// the journal is applied when the zone is loaded again
+	var reload *Zone
+	if reload, err = NewZone(option); nil != err {
+		t.Fatal(err)
+	}
+	if reload.SOA.Serial != zone.SOA.Serial || reload.Length() != zone.Length() {
+		t.Errorf("reload zone got serial %d length %d, want %d %d", reload.SOA.Serial, reload.Length(), zone.SOA.Serial, zone.Length())
+	}
+
+	// the incomplete change at the end of the journal is skipped
+	var fp *os.File
+	if fp, err = os.OpenFile(option.Journal, os.O_APPEND|os.O_WRONLY, 0644); nil != err {
+		t.Fatal(err)
+	}
+	fp.WriteString("-" + zone.SOA.String() + "\n+www.corp.exa")
+	fp.Close()
+	if reload, err = NewZone(option); nil != err || reload.SOA.Serial != zone.SOA.Serial {
+		t.Errorf("reload zone with incomplete journal got %v", err)
+	}
+}
+
+func TestNameServerUpdate(t *testing.T) {
+	var path = filepath.Join(t.TempDir(), "corp.zone")
+	if err := os.WriteFile(path, []byte(testZone), 0644); nil != err {
+		t.Fatal(err)
+	}
+
+	var secret = "dXBkYXRlLWtleS1zZWNyZXQ="
+	var option = ZoneOption{Name: "corp.example.", File: path, Update: []string{"127.0.0.1"}, UpdateKey: "update.key."}
+	if err := option.Init(); nil != err {
+		t.Fatal(err)
+	}
+
+	var service = newTestService()
+	var err error
+	if service.zones, err = NewZones([]ZoneOption{option}); nil != err {
+		t.Fatal(err)
+	}
+	if service.tsig, err = NewTSIGKeys(map[string]string{"update.key.": secret}); nil != err {
+		t.Fatal(err)
+	}
+
+	var handle, _ = NewNameServer(service, "tcp", "")
+	var ns = handle.(*NameServer)
+	var started = make(chan struct{})
+	ns.server.NotifyStartedFunc = func() { close(started) }
+	if ns.server.Listener, err = net.Listen("tcp", "127.0.0.1:0"); nil != err {
+		t.Fatal(err)
+	}
+	go ns.server.ActivateAndServe()
+	defer ns.Stop()
+	<-started
+
+	var client = &dns.Client{Net: "tcp", TsigSecret: map[string]string{"update.key.": secret}}
+	var send = func(key string) (*dns.Msg, error) {
+		var msg = new(dns.Msg)
+		msg.SetUpdate("corp.example.")
+		var rr, _ = dns.NewRR("dhcp.corp.example. 300 IN A 10.0.2.1")
+		msg.Insert([]dns.RR{rr})
+		if "" != key {
+			msg.SetTsig(key, dns.HmacSHA256, 300, time.Now().Unix())
+		}
+
+		var resp, _, err = client.Exchange(msg, ns.server.Listener.Addr().String())
+
+		return resp, err
+	}
+
+	if resp, err := send(""); nil != err || dns.RcodeRefused != resp.Rcode {
+		t.Errorf("unsigned update got %v %v", resp, err)
+	}
+
+	// the answer of the signed update is signed and verified by the client
+	var resp *dns.Msg
+	if resp, err = send("update.key."); nil != err || dns.RcodeSuccess != resp.Rcode || nil == resp.IsTsig() {
+		t.Fatalf("signed update got %v %v", resp, err)
+	}
+
+	var req = new(dns.Msg)
+	req.SetQuestion("dhcp.corp.example.", dns.TypeA)
+	if resp, err = service.Query("127.0.0.1:1", req); nil != err || 1 != len(resp.Answer) || !resp.Authoritative {
+		t.Errorf("query updated record got %v %v", resp, err)
+	}
+}
+
+func TestServiceUpdateReverse(t *testing.T) {
+	var path = filepath.Join(t.TempDir(), "corp.zone")
+	if err := os.WriteFile(path, []byte(testZone), 0644); nil != err {
+		t.Fatal(err)
+	}
+
+	var option = ZoneOption{Name: "corp.example.", File: path, UpdateKey: "update.key."}
+	if err := option.Init(); nil != err {
+		t.Fatal(err)
+	}
+
+	var service = newTestService()
+	var err error
+	if service.zones, err = NewZones([]ZoneOption{option}); nil != err {
+		t.Fatal(err)
+	}
+	service.reverse = NewReverseTable()
+
+	// the concurrent update and query share the PTR record, every updated address has PTR record at last
+	var wg sync.WaitGroup
+	for i := 1; i <= 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+
+			var msg = new(dns.Msg)
+			msg.SetUpdate("corp.example.")
+			var rr, _ = dns.NewRR(fmt.Sprintf("host%d.corp.example. 300 IN A 10.0.3.%d", i, i))
+			msg.Insert([]dns.RR{rr})
+			msg.SetTsig("update.key.", dns.HmacSHA256, 300, time.Now().Unix())
+			if rcode := service.Update("127.0.0.1:1", msg, nil); dns.RcodeSuccess != rcode {
+				t.Errorf("update host%d got %s", i, dns.RcodeToString[rcode])
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+
+			var req = new(dns.Msg)
+			req.SetQuestion(fmt.Sprintf("%d.3.0.10.in-addr.arpa.", i), dns.TypePTR)
+			service.getFromCache(req)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 1; i <= 8; i++ {
+		var req = new(dns.Msg)
+		req.SetQuestion(fmt.Sprintf("%d.3.0.10.in-addr.arpa.", i), dns.TypePTR)
+		if resp, err := service.getFromReverse(req); nil != err || 1 != len(resp.Answer) {
+			t.Errorf("ptr of updated host%d got %v %v", i, resp, err)
+		}
+	}
+}
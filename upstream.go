@@ -0,0 +1,490 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// upstreamIdle max number of idle connection kept by one stream upstream
+const upstreamIdle = 8
+
+// Upstream dns query forwarder transport
+type Upstream interface {
+	// Exchange send query to the forwarder and wait the answer until the context is done
+	Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, time.Duration, error)
+	// Address forwarder address of the config
+	Address() string
+	// Close close idle connection
+	Close()
+}
+
+// NewUpstream create forwarder transport by the address scheme
+// ip:port and udp:// is plain udp, tcp:// is plain tcp, tls:// is DNS over TLS, https:// is DNS over HTTPS, quic:// is DNS over QUIC
+// tls and quic address can spec the certificate name after #, like tls://1.1.1.1:853#cloudflare-dns.com
+// https address can spec the bootstrap ip after #, like https://dns.google/dns-query#8.8.8.8
+func NewUpstream(addr string, timeout time.Duration) (Upstream, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "udp://" + addr
+	}
+
+	var u, err = url.Parse(addr)
+	if nil != err {
+		return nil, errors.New("proxy: forwarder " + addr + " is invalid, " + err.Error())
+	}
+	if "" == u.Host {
+		return nil, errors.New("proxy: forwarder " + addr + " miss host")
+	}
+
+	switch u.Scheme {
+	case "udp":
+		return &udpUpstream{
+			addr: addr,
+			host: hostPort(u.Host, "53"),
+			client: &dns.Client{
+				Net:     "udp",
+				UDPSize: dns.DefaultMsgSize * 2,
+				Timeout: timeout,
+			},
+			tcp: &dns.Client{
+				Net:     "tcp",
+				Timeout: timeout,
+			},
+		}, nil
+	case "tcp":
+		return newStreamUpstream(addr, hostPort(u.Host, "53"), nil, timeout), nil
+	case "tls":
+		var name = u.Fragment
+		if "" == name {
+			name = u.Hostname()
+		}
+
+		return newStreamUpstream(addr, hostPort(u.Host, "853"), &tls.Config{ServerName: name, MinVersion: tls.VersionTLS12}, timeout), nil
+	case "https":
+		if "" == u.Path {
+			u.Path = "/dns-query"
+		}
+
+		return newHTTPSUpstream(addr, u, timeout), nil
+	case "quic":
+		var name = u.Fragment
+		if "" == name {
+			name = u.Hostname()
+		}
+
+		return &quicUpstream{
+			addr:    addr,
+			host:    hostPort(u.Host, "853"),
+			timeout: timeout,
+			config:  &tls.Config{ServerName: name, MinVersion: tls.VersionTLS13, NextProtos: []string{"doq"}},
+			mu:      new(sync.Mutex),
+		}, nil
+	}
+
+	return nil, errors.New("proxy: forwarder " + addr + " not support scheme " + u.Scheme)
+}
+
+// hostPort add the default port when the host has no port
+func hostPort(host string, port string) string {
+	if _, _, err := net.SplitHostPort(host); nil == err {
+		return host
+	}
+
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// udpUpstream plain udp forwarder
+type udpUpstream struct {
+	addr   string      `label:"forwarder config address"`
+	host   string      `label:"forwarder ip:port"`
+	client *dns.Client `label:"udp dns client"`
+	tcp    *dns.Client `label:"tcp dns client for truncated answer"`
+}
+
+// Exchange send query over udp, the truncated answer is retried over tcp to the same forwarder
+// the truncated answer is returned only when the tcp retry failed, it is never cached
+func (u *udpUpstream) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+	var resp, rtt, err = u.client.ExchangeContext(ctx, req, u.host)
+	if nil != err || !resp.Truncated {
+		return resp, rtt, err
+	}
+
+	if full, tcpRtt, err := u.tcp.ExchangeContext(ctx, req, u.host); nil == err {
+		return full, rtt + tcpRtt, nil
+	}
+
+	return resp, rtt, nil
+}
+
+// Address forwarder address of the config
+func (u *udpUpstream) Address() string {
+	return u.addr
+}
+
+// Close nothing to close for udp
+func (u *udpUpstream) Close() {}
+
+// streamUpstream plain tcp or DNS over TLS forwarder with connection pool
+type streamUpstream struct {
+	addr    string         `label:"forwarder config address"`
+	host    string         `label:"forwarder ip:port"`
+	timeout time.Duration  `label:"dial timeout"`
+	config  *tls.Config    `label:"tls config, nil is plain tcp"`
+	idle    chan *dns.Conn `label:"idle connection pool"`
+}
+
+// newStreamUpstream create tcp or tls forwarder
+func newStreamUpstream(addr string, host string, config *tls.Config, timeout time.Duration) *streamUpstream {
+	return &streamUpstream{
+		addr:    addr,
+		host:    host,
+		timeout: timeout,
+		config:  config,
+		idle:    make(chan *dns.Conn, upstreamIdle),
+	}
+}
+
+// Exchange send query over a pooled connection, retry once with new connection when the pooled one is broken
+func (u *streamUpstream) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+	var err error
+	var resp *dns.Msg
+	var start = time.Now()
+
+	for i := 0; i < 2; i++ {
+		var conn, reused = u.get()
+		if nil == conn {
+			if conn, err = u.dial(ctx); nil != err {
+				return nil, 0, err
+			}
+		}
+
+		if resp, err = u.exchange(ctx, conn, req); nil == err {
+			u.put(conn)
+
+			return resp, time.Since(start), nil
+		}
+
+		conn.Close()
+		if !reused || nil != ctx.Err() {
+			break
+		}
+	}
+
+	return nil, 0, err
+}
+
+// Address forwarder address of the config
+func (u *streamUpstream) Address() string {
+	return u.addr
+}
+
+// Close close all idle connection
+func (u *streamUpstream) Close() {
+	for {
+		select {
+		case conn := <-u.idle:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// get get idle connection from the pool
+func (u *streamUpstream) get() (*dns.Conn, bool) {
+	select {
+	case conn := <-u.idle:
+		return conn, true
+	default:
+		return nil, false
+	}
+}
+
+// put return connection to the pool, close it when the pool is full
+func (u *streamUpstream) put(conn *dns.Conn) {
+	conn.SetDeadline(time.Time{})
+
+	select {
+	case u.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// dial create new connection
+func (u *streamUpstream) dial(ctx context.Context) (*dns.Conn, error) {
+	var err error
+	var conn net.Conn
+	var dialer = &net.Dialer{Timeout: u.timeout}
+
+	if nil == u.config {
+		conn, err = dialer.DialContext(ctx, "tcp", u.host)
+	} else {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: u.config}).DialContext(ctx, "tcp", u.host)
+	}
+	if nil != err {
+		return nil, err
+	}
+
+	return &dns.Conn{Conn: conn}, nil
+}
+
+// exchange write query and read the answer of the same id
+func (u *streamUpstream) exchange(ctx context.Context, conn *dns.Conn, req *dns.Msg) (*dns.Msg, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(u.timeout))
+	}
+
+	if err := conn.WriteMsg(req); nil != err {
+		return nil, err
+	}
+
+	for {
+		var resp, err = conn.ReadMsg()
+		if nil != err {
+			return nil, err
+		}
+		if resp.Id == req.Id {
+			return resp, nil
+		}
+	}
+}
+
+// httpsUpstream DNS over HTTPS forwarder (RFC 8484), the http transport keep the connection pool
+type httpsUpstream struct {
+	addr   string       `label:"forwarder config address"`
+	url    string       `label:"dns query url"`
+	client *http.Client `label:"http client"`
+}
+
+// newHTTPSUpstream create DNS over HTTPS forwarder
+func newHTTPSUpstream(addr string, u *url.URL, timeout time.Duration) *httpsUpstream {
+	var dialer = &net.Dialer{Timeout: timeout}
+	var transport = &http.Transport{
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: upstreamIdle,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: timeout,
+		DialContext:         dialer.DialContext,
+	}
+
+	// dial the bootstrap ip, so the forwarder host is not resolved by the proxy itself
+	if bootstrap := u.Fragment; "" != bootstrap {
+		var port = u.Port()
+		if "" == port {
+			port = "443"
+		}
+
+		transport.DialContext = func(ctx context.Context, network string, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, net.JoinHostPort(bootstrap, port))
+		}
+	}
+
+	var query = *u
+	query.Fragment = ""
+
+	return &httpsUpstream{
+		addr:   addr,
+		url:    query.String(),
+		client: &http.Client{Transport: transport},
+	}
+}
+
+// Exchange post query as application/dns-message, the message id is 0 for http cache friendly
+func (u *httpsUpstream) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+	var start = time.Now()
+	var msg = req.Copy()
+	msg.Id = 0
+
+	var buf, err = msg.Pack()
+	if nil != err {
+		return nil, 0, err
+	}
+
+	var post *http.Request
+	if post, err = http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(buf)); nil != err {
+		return nil, 0, err
+	}
+	post.Header.Set("Content-Type", dohMediaType)
+	post.Header.Set("Accept", dohMediaType)
+
+	var ret *http.Response
+	if ret, err = u.client.Do(post); nil != err {
+		return nil, 0, err
+	}
+	defer ret.Body.Close()
+
+	if http.StatusOK != ret.StatusCode {
+		return nil, 0, errors.New("proxy: forwarder " + u.addr + " response http status " + ret.Status)
+	}
+	if buf, err = io.ReadAll(io.LimitReader(ret.Body, dns.MaxMsgSize)); nil != err {
+		return nil, 0, err
+	}
+
+	var resp = new(dns.Msg)
+	if err = resp.Unpack(buf); nil != err {
+		return nil, 0, err
+	}
+	resp.Id = req.Id
+
+	return resp, time.Since(start), nil
+}
+
+// Address forwarder address of the config
+func (u *httpsUpstream) Address() string {
+	return u.addr
+}
+
+// Close close idle connection
+func (u *httpsUpstream) Close() {
+	u.client.CloseIdleConnections()
+}
+
+// quicUpstream DNS over QUIC forwarder (RFC 9250), all query share one connection and every query use a new stream
+type quicUpstream struct {
+	addr    string        `label:"forwarder config address"`
+	host    string        `label:"forwarder ip:port"`
+	timeout time.Duration `label:"dial timeout"`
+	config  *tls.Config   `label:"tls config"`
+	mu      *sync.Mutex   `label:"connection lock"`
+	conn    *quic.Conn    `label:"shared quic connection"`
+}
+
+// Exchange send query on new stream, redial once when the shared connection is closed
+func (u *quicUpstream) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+	var err error
+	var resp *dns.Msg
+	var start = time.Now()
+
+	for i := 0; i < 2; i++ {
+		var conn, reused = u.get()
+		if nil == conn {
+			if conn, err = u.dial(ctx); nil != err {
+				return nil, 0, err
+			}
+		}
+
+		if resp, err = u.exchange(ctx, conn, req); nil == err {
+			return resp, time.Since(start), nil
+		}
+
+		// stream error keep the connection, other query on it still work
+		if nil == conn.Context().Err() {
+			break
+		}
+		u.drop(conn)
+		if !reused || nil != ctx.Err() {
+			break
+		}
+	}
+
+	return nil, 0, err
+}
+
+// Address forwarder address of the config
+func (u *quicUpstream) Address() string {
+	return u.addr
+}
+
+// Close close the shared connection
+func (u *quicUpstream) Close() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if nil != u.conn {
+		u.conn.CloseWithError(doqNoError, "")
+		u.conn = nil
+	}
+}
+
+// get get the shared connection when it is alive
+func (u *quicUpstream) get() (*quic.Conn, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if nil != u.conn && nil == u.conn.Context().Err() {
+		return u.conn, true
+	}
+
+	return nil, false
+}
+
+// dial create new shared connection
+func (u *quicUpstream) dial(ctx context.Context) (*quic.Conn, error) {
+	var dialCtx, cancel = context.WithTimeout(ctx, u.timeout)
+	defer cancel()
+
+	var conn, err = quic.DialAddr(dialCtx, u.host, u.config, &quic.Config{
+		HandshakeIdleTimeout: u.timeout,
+		KeepAlivePeriod:      15 * time.Second,
+	})
+	if nil != err {
+		return nil, err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	// other query dial the shared connection at the same time
+	if nil != u.conn && nil == u.conn.Context().Err() {
+		conn.CloseWithError(doqNoError, "")
+		return u.conn, nil
+	}
+	u.conn = conn
+
+	return conn, nil
+}
+
+// drop close the broken connection
+func (u *quicUpstream) drop(conn *quic.Conn) {
+	u.mu.Lock()
+	if u.conn == conn {
+		u.conn = nil
+	}
+	u.mu.Unlock()
+
+	conn.CloseWithError(doqNoError, "")
+}
+
+// exchange write query with id 0 on new stream and read the answer
+func (u *quicUpstream) exchange(ctx context.Context, conn *quic.Conn, req *dns.Msg) (*dns.Msg, error) {
+	var stream, err = conn.OpenStreamSync(ctx)
+	if nil != err {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	} else {
+		stream.SetDeadline(time.Now().Add(u.timeout))
+	}
+
+	var msg = req.Copy()
+	msg.Id = 0
+	if err = writeQUICMsg(stream, msg); nil != err {
+		stream.CancelRead(quic.StreamErrorCode(doqNoError))
+		return nil, err
+	}
+
+	var resp *dns.Msg
+	if resp, err = readQUICMsg(stream); nil != err {
+		stream.CancelRead(quic.StreamErrorCode(doqNoError))
+		return nil, err
+	}
+	resp.Id = req.Id
+
+	return resp, nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startTestNameServer start plain dns server on loopback answer every query with 192.0.2.1
+func startTestNameServer(t *testing.T, network string) string {
+	var handle = dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		var resp = new(dns.Msg)
+		resp.SetReply(req)
+		resp.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.IPv4(192, 0, 2, 1),
+		}}
+		w.WriteMsg(resp)
+	})
+
+	var server = &dns.Server{Net: network, Handler: handle}
+	var started = make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+
+	if "udp" == network {
+		var conn, err = net.ListenPacket("udp", "127.0.0.1:0")
+		if nil != err {
+			t.Fatal(err)
+		}
+		server.PacketConn = conn
+	} else {
+		var listener, err = net.Listen("tcp", "127.0.0.1:0")
+		if nil != err {
+			t.Fatal(err)
+		}
+		server.Listener = listener
+	}
+
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+
+	if nil != server.PacketConn {
+		return server.PacketConn.LocalAddr().String()
+	}
+
+	return server.Listener.Addr().String()
+}
+
+func TestNewUpstream(t *testing.T) {
+	var cases = map[string]string{
+		"8.8.8.8:53":                           "8.8.8.8:53",
+		"udp://8.8.8.8":                        "8.8.8.8:53",
+		"tcp://[2001:4860:4860::8888]":         "[2001:4860:4860::8888]:53",
+		"tls://1.1.1.1:853#cloudflare-dns.com": "1.1.1.1:853",
+		"tls://dns.google":                     "dns.google:853",
+	}
+	for addr, host := range cases {
+		var upstream, err = NewUpstream(addr, time.Second)
+		if nil != err {
+			t.Errorf("create upstream %s error: %v", addr, err)
+			continue
+		}
+
+		switch u := upstream.(type) {
+		case *udpUpstream:
+			if u.host != host {
+				t.Errorf("upstream %s host got %s, want %s", addr, u.host, host)
+			}
+		case *streamUpstream:
+			if u.host != host {
+				t.Errorf("upstream %s host got %s, want %s", addr, u.host, host)
+			}
+		}
+	}
+
+	var tls, _ = NewUpstream("tls://1.1.1.1:853#cloudflare-dns.com", time.Second)
+	if "cloudflare-dns.com" != tls.(*streamUpstream).config.ServerName {
+		t.Errorf("tls upstream server name got %s", tls.(*streamUpstream).config.ServerName)
+	}
+	var doh, _ = NewUpstream("https://dns.google/dns-query#8.8.8.8", time.Second)
+	if "https://dns.google/dns-query" != doh.(*httpsUpstream).url {
+		t.Errorf("https upstream url got %s", doh.(*httpsUpstream).url)
+	}
+
+	for _, addr := range []string{"quic+x://1.1.1.1", "tls://", "ftp://1.1.1.1"} {
+		if _, err := NewUpstream(addr, time.Second); nil == err {
+			t.Errorf("create upstream %s should failed", addr)
+		}
+	}
+}
+
+func TestUpstreamExchange(t *testing.T) {
+	var upstreams []Upstream
+
+	for _, network := range []string{"udp", "tcp"} {
+		var upstream, err = NewUpstream(network+"://"+startTestNameServer(t, network), time.Second)
+		if nil != err {
+			t.Fatal(err)
+		}
+		upstreams = append(upstreams, upstream)
+	}
+
+	// DNS over TLS forwarder to the loopback tls listener
+	var service = newTestService("www.example.com. 300 IN A 192.0.2.1")
+	service.cert = NewCertStore()
+	service.config.TLS = writeTestCert(t, "dns.test")
+	if err := service.cert.Load(service.config.TLS); nil != err {
+		t.Fatal(err)
+	}
+	var handle, _ = NewTLSServer(service, "tls", "127.0.0.1:0")
+	var server = handle.(*TLSServer)
+	go server.Start()
+	t.Cleanup(func() { server.Stop() })
+	var addr string
+	for i := 0; i < 100 && "" == addr; i++ {
+		time.Sleep(10 * time.Millisecond)
+		server.mu.Lock()
+		if nil != server.listener {
+			addr = server.listener.Addr().String()
+		}
+		server.mu.Unlock()
+	}
+
+	var pem, err = os.ReadFile(service.config.TLS.Cert)
+	if nil != err {
+		t.Fatal(err)
+	}
+	var pool = x509.NewCertPool()
+	pool.AppendCertsFromPEM(pem)
+
+	var dot, _ = NewUpstream("tls://"+addr+"#dns.test", time.Second)
+	dot.(*streamUpstream).config.RootCAs = pool
+	upstreams = append(upstreams, dot)
+
+	// DNS over HTTPS forwarder to the loopback https endpoint
+	var ts = httptest.NewTLSServer(http.HandlerFunc((&HTTPServer{service: service}).dnsQuery))
+	t.Cleanup(ts.Close)
+
+	var doh, _ = NewUpstream(ts.URL+"/dns-query", time.Second)
+	doh.(*httpsUpstream).client = ts.Client()
+	upstreams = append(upstreams, doh)
+
+	for _, upstream := range upstreams {
+		// the second query reuse the pooled connection
+		for i := 0; i < 2; i++ {
+			var req = new(dns.Msg)
+			req.SetQuestion("www.example.com.", dns.TypeA)
+
+			var ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+			var resp, _, err = upstream.Exchange(ctx, req)
+			cancel()
+
+			if nil != err || resp.Id != req.Id || 1 != len(resp.Answer) {
+				t.Errorf("upstream %s exchange got %v %v", upstream.Address(), resp, err)
+			}
+		}
+
+		if stream, ok := upstream.(*streamUpstream); ok && 1 != len(stream.idle) {
+			t.Errorf("upstream %s pool %d idle connection, want 1", upstream.Address(), len(stream.idle))
+		}
+		upstream.Close()
+	}
+}
+
+func TestUpstreamTruncated(t *testing.T) {
+	var handle = dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		var resp = new(dns.Msg)
+		resp.SetReply(req)
+		for i := 0; i < 64; i++ {
+			resp.Answer = append(resp.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300},
+				Txt: []string{strings.Repeat("x", 200)},
+			})
+		}
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			resp.Truncate(dns.MinMsgSize)
+		}
+		w.WriteMsg(resp)
+	})
+
+	// udp and tcp server on the same port
+	var conn, err = net.ListenPacket("udp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	var listener net.Listener
+	if listener, err = net.Listen("tcp", conn.LocalAddr().String()); nil != err {
+		t.Fatal(err)
+	}
+	for _, server := range []*dns.Server{{PacketConn: conn, Handler: handle}, {Listener: listener, Handler: handle}} {
+		go server.ActivateAndServe()
+		defer server.Shutdown()
+	}
+
+	var upstream Upstream
+	if upstream, err = NewUpstream(conn.LocalAddr().String(), time.Second); nil != err {
+		t.Fatal(err)
+	}
+
+	var req = new(dns.Msg)
+	req.SetQuestion("txt.example.com.", dns.TypeTXT)
+	var resp *dns.Msg
+	if resp, _, err = upstream.Exchange(context.Background(), req); nil != err {
+		t.Fatal(err)
+	}
+	if resp.Truncated || 64 != len(resp.Answer) {
+		t.Errorf("truncated answer retry over tcp got tc %v with %d answer", resp.Truncated, len(resp.Answer))
+	}
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// zoneChain max number of CNAME followed in one zone answer
+const zoneChain = 8
+
+// ZoneOption authoritative local zone option
+type ZoneOption struct {
+	Name        string   `json:"name" label:"zone origin, like corp.example."`
+	File        string   `json:"file" label:"RFC 1035 master file path"`
+	Transfer    []string `json:"transfer" label:"ip or cidr of client allowed to transfer the zone"`
+	TransferKey string   `json:"transfer_key" label:"tsig key name of zone transfer"`
+	Update      []string `json:"update" label:"ip or cidr of client allowed to update the zone, empty is any client"`
+	UpdateKey   string   `json:"update_key" label:"tsig key name of dynamic update, empty is update disabled"`
+	Journal     string   `json:"journal" label:"journal file of dynamic update, default is the zone file with .jnl suffix"`
+}
+
+// Init check zone option
+func (o *ZoneOption) Init() error {
+	if "" == o.Name || "" == o.File {
+		return errors.New("proxy: zone miss name or file")
+	}
+
+	o.Name = dns.Fqdn(strings.ToLower(o.Name))
+	if _, ok := dns.IsDomainName(o.Name); !ok {
+		return errors.New("proxy: zone name " + o.Name + " is invalid")
+	}
+	if _, err := parseACL(o.Transfer); nil != err {
+		return err
+	}
+	if _, err := parseACL(o.Update); nil != err {
+		return err
+	}
+	if "" != o.TransferKey {
+		o.TransferKey = dns.CanonicalName(o.TransferKey)
+	}
+	if "" != o.UpdateKey {
+		o.UpdateKey = dns.CanonicalName(o.UpdateKey)
+	}
+	if "" == o.Journal {
+		o.Journal = o.File + ".jnl"
+	}
+
+	return nil
+}
+
+// parseACL parse the ip or cidr list, the ip is the single address network
+func parseACL(list []string) ([]*net.IPNet, error) {
+	var acl = make([]*net.IPNet, 0, len(list))
+	for _, v := range list {
+		if !strings.Contains(v, "/") {
+			var ip = net.ParseIP(v)
+			if nil == ip {
+				return nil, errors.New("proxy: acl " + v + " is not ip or cidr")
+			}
+			if nil != ip.To4() {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+
+		var _, ipnet, err = net.ParseCIDR(v)
+		if nil != err {
+			return nil, errors.New("proxy: acl " + v + " is not ip or cidr")
+		}
+		acl = append(acl, ipnet)
+	}
+
+	return acl, nil
+}
+
+// Zone authoritative zone loaded from master file
+type Zone struct {
+	Origin    string              `label:"zone origin"`
+	SOA       *dns.SOA            `label:"start of authority record"`
+	NS        []dns.RR            `label:"zone apex name server"`
+	records   map[string][]dns.RR `label:"record of the owner name"`
+	names     map[string]bool     `label:"every owner name and empty non-terminal"`
+	acl       []*net.IPNet        `label:"client allowed to transfer the zone"`
+	key       string              `label:"tsig key name of zone transfer"`
+	updateACL []*net.IPNet        `label:"client allowed to update the zone"`
+	updateKey string              `label:"tsig key name of dynamic update"`
+	journal   string              `label:"journal file of dynamic update"`
+	mu        *sync.RWMutex       `label:"lock of the dynamic update"`
+}
+
+// NewZone load zone from the master file, the zone must have SOA record at the apex
+func NewZone(option *ZoneOption) (*Zone, error) {
+	var fp, err = os.Open(option.File)
+	if nil != err {
+		return nil, err
+	}
+	defer fp.Close()
+
+	var z = &Zone{
+		Origin:    option.Name,
+		records:   make(map[string][]dns.RR),
+		names:     make(map[string]bool),
+		key:       option.TransferKey,
+		updateKey: option.UpdateKey,
+		journal:   option.Journal,
+		mu:        new(sync.RWMutex),
+	}
+	if z.acl, err = parseACL(option.Transfer); nil != err {
+		return nil, err
+	}
+	if z.updateACL, err = parseACL(option.Update); nil != err {
+		return nil, err
+	}
+
+	var parser = dns.NewZoneParser(fp, option.Name, option.File)
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		if err = z.Add(rr); nil != err {
+			return nil, err
+		}
+	}
+	if err = parser.Err(); nil != err {
+		return nil, errors.New("proxy: load zone " + option.Name + " failed, " + err.Error())
+	}
+	if nil == z.SOA {
+		return nil, errors.New("proxy: zone " + option.Name + " miss SOA record")
+	}
+
+	// the dynamic update of the journal is applied on the zone file
+	if "" != z.journal {
+		if err = z.replay(); nil != err {
+			return nil, err
+		}
+	}
+
+	return z, nil
+}
+
+// Add add record to the zone, the record out of the zone is rejected
+func (z *Zone) Add(rr dns.RR) error {
+	var name = strings.ToLower(rr.Header().Name)
+	if !dns.IsSubDomain(z.Origin, name) {
+		return errors.New("proxy: record " + rr.Header().Name + " is out of zone " + z.Origin)
+	}
+	rr.Header().Name = name
+
+	switch v := rr.(type) {
+	case *dns.SOA:
+		if name != z.Origin {
+			return errors.New("proxy: SOA record " + name + " is not at the zone apex " + z.Origin)
+		}
+		z.SOA = v
+	case *dns.NS:
+		if name == z.Origin {
+			z.NS = append(z.NS, v)
+		}
+	}
+
+	z.records[name] = append(z.records[name], rr)
+	for n := name; !z.names[n]; {
+		z.names[n] = true
+		if n == z.Origin {
+			break
+		}
+
+		var off, _ = dns.NextLabel(n, 0)
+		n = n[off:]
+	}
+
+	return nil
+}
+
+// Length number of record in the zone
+func (z *Zone) Length() int {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	var cnt int
+	for _, rrs := range z.records {
+		cnt += len(rrs)
+	}
+
+	return cnt
+}
+
+// Answer answer the query of the name in the zone
+// delegated name get the referral, the missing name get NXDOMAIN and the missing type get NODATA with the SOA
+func (z *Zone) Answer(req *dns.Msg) *dns.Msg {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	var q = req.Question[0]
+	var resp = new(dns.Msg)
+	resp.SetReply(req)
+	resp.Authoritative = true
+
+	var owner = q.Name
+	var name = strings.ToLower(q.Name)
+	for i := 0; i < zoneChain; i++ {
+		if cut := z.delegation(name, q.Qtype); nil != cut {
+			// referral is not authoritative, the answer of the former CNAME is kept
+			resp.Authoritative = 0 != len(resp.Answer)
+			resp.Ns = cut
+			resp.Extra = z.glue(cut)
+
+			return resp
+		}
+
+		var rrs, ok = z.lookup(name)
+		if !ok {
+			resp.Rcode = dns.RcodeNameError
+			resp.Ns = []dns.RR{z.negative()}
+
+			return resp
+		}
+
+		var matched bool
+		var target string
+		for _, rr := range rrs {
+			if q.Qtype == rr.Header().Rrtype || dns.TypeANY == q.Qtype {
+				matched = true
+				resp.Answer = append(resp.Answer, zoneRecord(rr, owner))
+			} else if cname, isCNAME := rr.(*dns.CNAME); isCNAME {
+				resp.Answer = append(resp.Answer, zoneRecord(rr, owner))
+				target = strings.ToLower(cname.Target)
+			}
+		}
+
+		if "" == target || matched {
+			if !matched {
+				resp.Ns = []dns.RR{z.negative()}
+			}
+
+			return resp
+		}
+		if !dns.IsSubDomain(z.Origin, target) {
+			return resp
+		}
+		owner, name = target, target
+	}
+
+	return resp
+}
+
+// Addresses get the copy of the authoritative A and AAAA record of the zone ordered by the owner name, the wildcard and the glue under a zone cut are skipped
+func (z *Zone) Addresses() []dns.RR {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	var names = make([]string, 0, len(z.records))
+	for name := range z.records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var ret []dns.RR
+	for _, name := range names {
+		if strings.HasPrefix(name, "*.") || nil != z.delegation(name, dns.TypeA) {
+			continue
+		}
+
+		for _, rr := range z.records[name] {
+			if dns.TypeA == rr.Header().Rrtype || dns.TypeAAAA == rr.Header().Rrtype {
+				ret = append(ret, dns.Copy(rr))
+			}
+		}
+	}
+
+	return ret
+}
+
+// Allow check the client can transfer the zone, the zone without ACL and key is never transferred
+// the client address must be in the ACL when it is set, and the request must be signed by the key when it is set
+func (z *Zone) Allow(ip net.IP, key string) bool {
+	if 0 == len(z.acl) && "" == z.key {
+		return false
+	}
+	if "" != z.key && key != z.key {
+		return false
+	}
+
+	return aclContains(z.acl, ip)
+}
+
+// AllowUpdate check the client can update the zone, the request must be signed by the update key
+// and the client address must be in the update ACL when it is set
+func (z *Zone) AllowUpdate(ip net.IP, key string) bool {
+	return "" != z.updateKey && key == z.updateKey && aclContains(z.updateACL, ip)
+}
+
+// aclContains check the ip is in the ACL, the empty ACL contains any ip
+func aclContains(acl []*net.IPNet, ip net.IP) bool {
+	if 0 == len(acl) {
+		return true
+	}
+
+	for _, ipnet := range acl {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Transfer get the record of the zone transfer, the SOA is the first and the last record (RFC 5936)
+// IXFR of the client serial not older than the zone get the SOA only (RFC 1995), otherwise the whole zone is sent like AXFR
+func (z *Zone) Transfer(req *dns.Msg) []dns.RR {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	if dns.TypeIXFR == req.Question[0].Qtype {
+		for _, rr := range req.Ns {
+			if soa, ok := rr.(*dns.SOA); ok && !serialNewer(z.SOA.Serial, soa.Serial) {
+				return []dns.RR{dns.Copy(z.SOA)}
+			}
+		}
+	}
+
+	var names = make([]string, 0, len(z.records))
+	for name := range z.records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var rrs = []dns.RR{dns.Copy(z.SOA)}
+	for _, name := range names {
+		for _, rr := range z.records[name] {
+			if dns.TypeSOA != rr.Header().Rrtype {
+				rrs = append(rrs, dns.Copy(rr))
+			}
+		}
+	}
+
+	return append(rrs, dns.Copy(z.SOA))
+}
+
+// serialNewer check the serial a is newer than b by the serial number arithmetic (RFC 1982)
+func serialNewer(a uint32, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+// lookup get the record of the name, the wildcard record of the closest encloser is used when the name is not exist
+// the empty non-terminal has no record but is exist
+func (z *Zone) lookup(name string) ([]dns.RR, bool) {
+	if z.names[name] {
+		return z.records[name], true
+	}
+
+	// find the closest encloser, the wildcard only match when the name under it is not exist
+	for n := name; n != z.Origin; {
+		var off, _ = dns.NextLabel(n, 0)
+		n = n[off:]
+
+		if z.names[n] {
+			var rrs, ok = z.records["*."+n]
+
+			return rrs, ok
+		}
+	}
+
+	return nil, false
+}
+
+// delegation get the NS record of the zone cut between the apex and the name
+// the DS record belongs to the parent side of the cut
+func (z *Zone) delegation(name string, qtype uint16) []dns.RR {
+	var labels = dns.SplitDomainName(name)
+	var apex = dns.CountLabel(z.Origin)
+
+	for i := len(labels) - apex - 1; i >= 0; i-- {
+		var n = dns.Fqdn(strings.Join(labels[i:], "."))
+		if 0 == i && dns.TypeDS == qtype {
+			break
+		}
+
+		var ns []dns.RR
+		for _, rr := range z.records[n] {
+			if dns.TypeNS == rr.Header().Rrtype {
+				ns = append(ns, rr)
+			}
+		}
+		if 0 != len(ns) {
+			return ns
+		}
+	}
+
+	return nil
+}
+
+// glue get the address record of the name server in the zone
+func (z *Zone) glue(ns []dns.RR) []dns.RR {
+	var extra []dns.RR
+	for _, rr := range ns {
+		var host = strings.ToLower(rr.(*dns.NS).Ns)
+		for _, a := range z.records[host] {
+			if dns.TypeA == a.Header().Rrtype || dns.TypeAAAA == a.Header().Rrtype {
+				extra = append(extra, a)
+			}
+		}
+	}
+
+	return extra
+}
+
+// negative get the SOA record of the negative answer, the ttl is the min of the SOA ttl and minimum field (RFC 2308)
+func (z *Zone) negative() dns.RR {
+	var soa = dns.Copy(z.SOA)
+	if z.SOA.Minttl < soa.Header().Ttl {
+		soa.Header().Ttl = z.SOA.Minttl
+	}
+
+	return soa
+}
+
+// zoneRecord copy the record for the answer, the wildcard record is answered with the owner name
+func zoneRecord(rr dns.RR, owner string) dns.RR {
+	var ret = dns.Copy(rr)
+	if strings.HasPrefix(ret.Header().Name, "*.") {
+		ret.Header().Name = owner
+	}
+
+	return ret
+}
+
+// Zones authoritative local zones
+type Zones struct {
+	zones map[string]*Zone `label:"zone by origin"`
+}
+
+// NewZones load every zone of the option
+func NewZones(options []ZoneOption) (*Zones, error) {
+	var z = &Zones{
+		zones: make(map[string]*Zone, len(options)),
+	}
+
+	for i := range options {
+		var zone, err = NewZone(&options[i])
+		if nil != err {
+			return nil, err
+		}
+
+		z.zones[zone.Origin] = zone
+	}
+
+	return z, nil
+}
+
+// Find get the closest zone of the name
+func (z *Zones) Find(name string) *Zone {
+	name = strings.ToLower(dns.Fqdn(name))
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if zone, ok := z.zones[name[off:]]; ok {
+			return zone
+		}
+	}
+
+	return nil
+}
+
+// Get get the zone of the origin
+func (z *Zones) Get(origin string) *Zone {
+	return z.zones[dns.CanonicalName(origin)]
+}
+
+// Length number of zone
+func (z *Zones) Length() int {
+	return len(z.zones)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testZone = `$TTL 600
+@        IN SOA  ns1 admin 2024010101 3600 600 86400 60
+@        IN NS   ns1
+@        IN MX   10 mail
+ns1      IN A    10.0.0.1
+www      IN A    10.0.0.2
+www      IN AAAA fd00::2
+git      IN CNAME www
+ext      IN CNAME www.example.org.
+*.dev    IN A    10.0.0.3
+a.b.deep IN A    10.0.0.4
+sub      IN NS   ns.sub
+sub      IN DS   12345 13 2 2BB183AF5F22588179A53B0A98631FAD1A292118AD8E3D3B4C3E8C5E1D5A1F00
+ns.sub   IN A    10.0.0.5
+`
+
+func TestZoneAnswer(t *testing.T) {
+	var path = filepath.Join(t.TempDir(), "corp.zone")
+	if err := os.WriteFile(path, []byte(testZone), 0644); nil != err {
+		t.Fatal(err)
+	}
+
+	var option = &ZoneOption{Name: "Corp.Example", File: path}
+	if err := option.Init(); nil != err || "corp.example." != option.Name {
+		t.Fatalf("zone option init got %s %v", option.Name, err)
+	}
+
+	var zones, err = NewZones([]ZoneOption{*option})
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 1 != zones.Length() || nil != zones.Find("example.") || nil != zones.Find("corp.example.org.") {
+		t.Fatal("zone find out of zone name")
+	}
+
+	var cases = []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		aa     bool
+		answer []uint16
+		ns     []uint16
+		extra  int
+	}{
+		{"www.corp.example.", dns.TypeA, dns.RcodeSuccess, true, []uint16{dns.TypeA}, nil, 0},
+		{"WWW.corp.example.", dns.TypeAAAA, dns.RcodeSuccess, true, []uint16{dns.TypeAAAA}, nil, 0},
+		{"www.corp.example.", dns.TypeTXT, dns.RcodeSuccess, true, nil, []uint16{dns.TypeSOA}, 0},
+		{"none.corp.example.", dns.TypeA, dns.RcodeNameError, true, nil, []uint16{dns.TypeSOA}, 0},
+		{"deep.corp.example.", dns.TypeA, dns.RcodeSuccess, true, nil, []uint16{dns.TypeSOA}, 0},
+		{"git.corp.example.", dns.TypeA, dns.RcodeSuccess, true, []uint16{dns.TypeCNAME, dns.TypeA}, nil, 0},
+		{"ext.corp.example.", dns.TypeA, dns.RcodeSuccess, true, []uint16{dns.TypeCNAME}, nil, 0},
+		{"x.dev.corp.example.", dns.TypeA, dns.RcodeSuccess, true, []uint16{dns.TypeA}, nil, 0},
+		{"x.dev.corp.example.", dns.TypeMX, dns.RcodeSuccess, true, nil, []uint16{dns.TypeSOA}, 0},
+		{"corp.example.", dns.TypeMX, dns.RcodeSuccess, true, []uint16{dns.TypeMX}, nil, 0},
+		{"host.sub.corp.example.", dns.TypeA, dns.RcodeSuccess, false, nil, []uint16{dns.TypeNS}, 1},
+		{"sub.corp.example.", dns.TypeDS, dns.RcodeSuccess, true, []uint16{dns.TypeDS}, nil, 0},
+	}
+	for _, c := range cases {
+		var req = new(dns.Msg)
+		req.SetQuestion(c.name, c.qtype)
+
+		var zone = zones.Find(c.name)
+		if nil == zone {
+			t.Errorf("zone %s not found", c.name)
+			continue
+		}
+
+		var resp = zone.Answer(req)
+		if c.rcode != resp.Rcode || c.aa != resp.Authoritative || resp.Id != req.Id || len(resp.Extra) != c.extra {
+			t.Errorf("zone %s %s got %s aa %v extra %d", c.name, dns.TypeToString[c.qtype], dns.RcodeToString[resp.Rcode], resp.Authoritative, len(resp.Extra))
+		}
+		if len(resp.Answer) != len(c.answer) || len(resp.Ns) != len(c.ns) {
+			t.Errorf("zone %s %s got answer %v ns %v", c.name, dns.TypeToString[c.qtype], resp.Answer, resp.Ns)
+			continue
+		}
+		for i, rr := range resp.Answer {
+			if c.answer[i] != rr.Header().Rrtype {
+				t.Errorf("zone %s %s answer %d got %s", c.name, dns.TypeToString[c.qtype], i, rr)
+			}
+		}
+		for i, rr := range resp.Ns {
+			if c.ns[i] != rr.Header().Rrtype {
+				t.Errorf("zone %s %s authority %d got %s", c.name, dns.TypeToString[c.qtype], i, rr)
+			}
+			if soa, ok := rr.(*dns.SOA); ok && 60 != soa.Hdr.Ttl {
+				t.Errorf("zone %s negative ttl got %d", c.name, soa.Hdr.Ttl)
+			}
+		}
+	}
+
+	// the wildcard answer the query name
+	var req = new(dns.Msg)
+	req.SetQuestion("x.dev.corp.example.", dns.TypeA)
+	if resp := zones.Find("x.dev.corp.example.").Answer(req); "x.dev.corp.example." != resp.Answer[0].Header().Name {
+		t.Errorf("zone wildcard owner got %s", resp.Answer[0].Header().Name)
+	}
+
+	// the wildcard and the glue has no PTR record
+	if rrs := zones.Get("corp.example.").Addresses(); 4 != len(rrs) {
+		t.Errorf("zone address got %v", rrs)
+	}
+
+	// record out of the zone is rejected
+	if err = os.WriteFile(path, []byte(testZone+"www.example.org. IN A 10.0.0.9\n"), 0644); nil != err {
+		t.Fatal(err)
+	}
+	if _, err = NewZone(option); nil == err {
+		t.Error("zone load out of zone record")
+	}
+}